@@ -3,12 +3,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
+	"github.com/a8m/envsubst"
 	"github.com/a8m/envsubst/parse"
+	"github.com/a8m/envsubst/vars"
 )
 
 var (
@@ -18,86 +22,247 @@ var (
 	noUnset  = flag.Bool("no-unset", false, "")
 	noEmpty  = flag.Bool("no-empty", false, "")
 	failFast = flag.Bool("fail-fast", false, "")
+	stream   = flag.Bool("stream", false, "")
+	secrets  = flag.Bool("file-secrets", false, "")
+	varsSep  = flag.String("vars-sep", "_", "")
+	varNames = flag.Bool("variables", false, "")
+	include  stringsFlag
+	exclude  stringsFlag
+	// layers of variables read from files, in command line order.
+	layers []layer
 )
 
-var usage = `Usage: envsubst [options...] <input>
+func init() {
+	flag.BoolVar(varNames, "v", false, "")
+	flag.Var(layerFlag(readEnvFile), "env-file", "")
+	flag.Var(layerFlag(readDir), "vars-dir", "")
+	flag.Var(layerFlag(readVars), "vars", "")
+	flag.Var(&include, "include", "")
+	flag.Var(&exclude, "exclude", "")
+}
+
+// stringsFlag collects the values of a repeatable flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// layer is a source of variables read from the named file or directory.
+type layer struct {
+	name string
+	read layerFlag
+}
+
+// layerFlag is a repeatable flag adding a layer of variables read by the
+// function for each of its values. The function is given the variables of
+// the previous layers, overridden by the environment.
+type layerFlag func(name string, src parse.Lookuper) (parse.Lookuper, error)
+
+func (f layerFlag) String() string {
+	return ""
+}
+
+func (f layerFlag) Set(v string) error {
+	layers = append(layers, layer{name: v, read: f})
+	return nil
+}
+
+func readEnvFile(name string, src parse.Lookuper) (parse.Lookuper, error) {
+	return vars.ReadDotenv(name, envsubst.WithSource(src))
+}
+
+func readDir(name string, _ parse.Lookuper) (parse.Lookuper, error) {
+	return vars.ReadDir(name, *varsSep)
+}
+
+func readVars(name string, _ parse.Lookuper) (parse.Lookuper, error) {
+	return vars.ReadVars(name, *varsSep)
+}
+
+var usage = `Usage: envsubst [options...] [SHELL-FORMAT]
+If a SHELL-FORMAT is given, only the variables referenced in it are substituted,
+e.g. envsubst '$HOST $PORT'. Other references are kept as is.
 Options:
-  -i         Specify file input, otherwise use last argument as input file.
-             If no input file is specified, read from stdin.
+  -i         Specify file input. If no input file is specified, read from stdin.
   -o         Specify file output. If none is specified, write to stdout.
   -no-digit  Do not replace variables starting with a digit. e.g. $1 and ${1}
   -no-unset  Fail if a variable is not set.
   -no-empty  Fail if a variable is set but empty.
   -fail-fast Fail on first error otherwise display all failures if restrictions are set.
+  -stream    Write the output as the input is read, with bounded memory. On error, the
+             output written to stdout up to the failure is kept. By default, the output
+             is written only if the substitution succeeds.
+  -env-file  Read variables from a .env file. Can be repeated, later files override earlier
+             ones, and the environment overrides all files.
+  -vars-dir  Read variables from a directory holding one file per variable, such as a
+             Kubernetes ConfigMap volume. Can be repeated, like -env-file. Subdirectories
+             are flattened like -vars: db/host is read by $DB_HOST and ${db.host}.
+  -vars      Read variables from a JSON or YAML file. Can be repeated, like -env-file.
+             Nested keys are flattened: db.host is read by $DB_HOST and ${db.host}.
+  -vars-sep  Separator of the flattened keys of -vars files and -vars-dir subdirectories,
+             defaults to "_".
+  -include   Substitute only the variables matching a shell pattern, e.g. -include 'APP_*'.
+             Other references are kept as is. Can be repeated.
+  -exclude   Never substitute the variables matching a shell pattern, e.g. -exclude 'SECRET_*'.
+             Their references are kept as is. Can be repeated.
+  -v, --variables
+             Output the variables referenced in SHELL-FORMAT, one per line, and exit.
+  -file-secrets
+             Read a variable NAME that is not set from the file named by NAME_FILE.
 `
 
 func main() {
 	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, fmt.Sprintf(usage))
+		fmt.Fprint(os.Stderr, usage)
 	}
 	flag.Parse()
-	var reader *bufio.Reader
+	if flag.NArg() > 1 {
+		usageAndExit(fmt.Sprintf("Too many arguments: %s.", strings.Join(flag.Args()[1:], " ")))
+	}
+	format := flag.Arg(0)
+	restrictions := &parse.Restrictions{
+		NoUnset: *noUnset,
+		NoEmpty: *noEmpty,
+		NoDigit: *noDigit,
+		Include: include,
+		Exclude: exclude,
+	}
+	flag.Visit(func(f *flag.Flag) {
+		// dotted names, such as ${db.host}, reference the keys of -vars files
+		// and the subdirectories of -vars-dir.
+		if f.Name == "vars" || f.Name == "vars-dir" {
+			restrictions.Dotted = true
+		}
+	})
+	// the SHELL-FORMAT is parsed as the input is, for -v and for the allowlist.
+	opts := []envsubst.Option{envsubst.WithName("SHELL-FORMAT")}
+	if restrictions.Dotted {
+		opts = append(opts, envsubst.Dotted())
+	}
+	if restrictions.NoDigit {
+		opts = append(opts, envsubst.NoDigit())
+	}
+	if *varNames {
+		if format == "" {
+			usageAndExit("Missing SHELL-FORMAT argument.")
+		}
+		names, err := envsubst.Variables(format, opts...)
+		if err != nil {
+			errorAndExit(err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
+	}
+	if format != "" {
+		names, err := envsubst.Variables(format, opts...)
+		if err != nil {
+			errorAndExit(err)
+		}
+		restrictions.Allow = append([]string{}, names...)
+	}
+	var reader io.Reader
 	if *input != "" {
 		file, err := os.Open(*input)
 		if err != nil {
 			usageAndExit(fmt.Sprintf("Error to open file input: %s.", *input))
 		}
 		defer file.Close()
-		reader = bufio.NewReader(file)
+		reader = file
 	} else {
 		stat, err := os.Stdin.Stat()
 		if err != nil || (stat.Mode()&os.ModeCharDevice) != 0 {
 			usageAndExit("")
 		}
-		reader = bufio.NewReader(os.Stdin)
+		reader = os.Stdin
 	}
-	// Collect input data.
-	var data string
-	for {
-		line, err := reader.ReadString('\n')
+	// Files are layered in command line order, below the environment.
+	env := parse.Layer{Name: "environment", Source: parse.Env(os.Environ()).Map()}
+	src := parse.NewChain(parse.LastMatch)
+	for _, l := range layers {
+		prev := parse.NewChain(parse.LastMatch, append(src.Layers[:len(src.Layers):len(src.Layers)], env)...)
+		vars, err := l.read(l.name, prev)
 		if err != nil {
-			if err == io.EOF {
-				data += line
-				break
-			}
-			usageAndExit("Failed to read input.")
+			errorAndExit(err)
 		}
-		data += line
-	}
-	var (
-		err  error
-		file *os.File
-	)
-	if *output != "" {
-		file, err = os.Create(*output)
-		if err != nil {
-			usageAndExit("Error to create the wanted output file.")
-		}
-	} else {
-		file = os.Stdout
+		src.Add(l.name, vars)
 	}
-	// Parse input string
+	src.Add(env.Name, env.Source)
+	// Substitute the input as it is read
 	parserMode := parse.AllErrors
 	if *failFast {
 		parserMode = parse.Quick
 	}
-	restrictions := &parse.Restrictions{*noUnset, *noEmpty, *noDigit}
-	result, err := (&parse.Parser{Name: "string", Env: os.Environ(), Restrict: restrictions, Mode: parserMode}).Parse(data)
-	if err != nil {
-		errorAndExit(err)
+	name := "stdin"
+	if *input != "" {
+		name = *input
 	}
-	if _, err := file.WriteString(result); err != nil {
-		filename := *output
-		if filename == "" {
-			filename = "STDOUT"
+	parser := &parse.Parser{Name: name, Source: src, Restrict: restrictions, Mode: parserMode}
+	if *secrets {
+		parser.Source = parse.NewFileSecrets(src)
+	}
+	if *stream {
+		file := openOutput(createOutput)
+		writer := bufio.NewWriter(file)
+		if _, err := parser.Copy(writer, reader); err != nil {
+			file.Abort()
+			errorAndExit(err)
+		}
+		if err := writer.Flush(); err != nil {
+			file.Abort()
+			writeErrorAndExit()
 		}
-		usageAndExit(fmt.Sprintf("Error writing output to: %s.", filename))
+		if err := file.Commit(); err != nil {
+			writeErrorAndExit()
+		}
+		return
+	}
+	// The output is held until the input is substituted, so that nothing is
+	// written on error.
+	var buf bytes.Buffer
+	if _, err := parser.Copy(&buf, reader); err != nil {
+		errorAndExit(err)
 	}
+	file := openOutput(createDirect)
+	if _, err := buf.WriteTo(file); err != nil {
+		file.Abort()
+		writeErrorAndExit()
+	}
+	if err := file.Commit(); err != nil {
+		writeErrorAndExit()
+	}
+}
+
+// openOutput opens the standard output, or the output file created by create.
+func openOutput(create func(path string) (*outputFile, error)) *outputFile {
+	if *output == "" {
+		return &outputFile{File: os.Stdout}
+	}
+	file, err := create(*output)
+	if err != nil {
+		usageAndExit("Error to create the wanted output file.")
+	}
+	return file
+}
+
+func writeErrorAndExit() {
+	filename := *output
+	if filename == "" {
+		filename = "STDOUT"
+	}
+	usageAndExit(fmt.Sprintf("Error writing output to: %s.", filename))
 }
 
 func usageAndExit(msg string) {
 	if msg != "" {
-		fmt.Fprintf(os.Stderr, msg)
+		fmt.Fprint(os.Stderr, msg)
 		fmt.Fprintf(os.Stderr, "\n\n")
 	}
 	flag.Usage()
@@ -106,6 +271,28 @@ func usageAndExit(msg string) {
 }
 
 func errorAndExit(e error) {
-	fmt.Fprintf(os.Stderr, "%v\n\n", e.Error())
+	fmt.Fprintf(os.Stderr, "%v\n\n", errorString(e))
 	os.Exit(1)
 }
+
+// errorString returns the message of e, prefixed by the template name, line
+// and column of the errors of the template, one per line.
+func errorString(e error) string {
+	switch e := e.(type) {
+	case interface{ Unwrap() []error }:
+		var lines []string
+		for _, err := range e.Unwrap() {
+			lines = append(lines, errorString(err))
+		}
+		return strings.Join(lines, "\n")
+	case *parse.SyntaxError:
+		return fmt.Sprintf("%s:%d:%d: %v", e.Name, e.Line, e.Column, e)
+	case *parse.UnsetError:
+		return fmt.Sprintf("%s:%d:%d: %v", e.Name, e.Line, e.Column, e)
+	case *parse.EmptyError:
+		return fmt.Sprintf("%s:%d:%d: %v", e.Name, e.Line, e.Column, e)
+	case *parse.EvalError:
+		return fmt.Sprintf("%s:%d:%d: %v", e.Name, e.Line, e.Column, e)
+	}
+	return e.Error()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// outputFile is the output file of the substitution. Unless it is written
+// directly, the output is written to a temporary file, renamed to the output
+// file on success, so that a failure doesn't leave a partial output file.
+type outputFile struct {
+	*os.File
+	path string      // output file replaced by the temporary file, if any
+	mode os.FileMode // permissions of the output file
+}
+
+// createOutput creates the output file path. Symbolic links are followed, and
+// the temporary file is created next to their target. Targets that are not
+// regular files, such as /dev/stdout, and files in a directory that can't be
+// written are written directly.
+func createOutput(path string) (*outputFile, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		target = path
+	}
+	mode := os.FileMode(0644)
+	fi, err := os.Lstat(target)
+	if err == nil {
+		if !fi.Mode().IsRegular() {
+			return createDirect(target)
+		}
+		// Keep the permissions of an existing output file.
+		mode = fi.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*")
+	if err != nil {
+		return createDirect(target)
+	}
+	return &outputFile{File: f, path: target, mode: mode}, nil
+}
+
+// createDirect creates the output file path, written directly.
+func createDirect(path string) (*outputFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &outputFile{File: f}, nil
+}
+
+// Commit closes the file, and replaces the output file by the temporary file.
+func (o *outputFile) Commit() error {
+	if o.path == "" {
+		return o.Close()
+	}
+	if err := o.Chmod(o.mode); err != nil {
+		o.Abort()
+		return err
+	}
+	if err := o.Close(); err != nil {
+		os.Remove(o.Name())
+		return err
+	}
+	if err := os.Rename(o.Name(), o.path); err != nil {
+		os.Remove(o.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort closes the file, and removes the temporary file, if any.
+func (o *outputFile) Abort() {
+	o.Close()
+	if o.path != "" {
+		os.Remove(o.Name())
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateOutputSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.txt")
+	link := filepath.Join(dir, "link.txt")
+	if err := os.WriteFile(target, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target.txt", link); err != nil {
+		t.Fatal(err)
+	}
+	write := func(content string, commit bool) {
+		f, err := createOutput(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+		if !commit {
+			f.Abort()
+			return
+		}
+		if err := f.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("aborted", false)
+	write("new", true)
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("%s is no longer a symbolic link (error: %v)", link, err)
+	}
+	if b, err := os.ReadFile(target); string(b) != "new" || err != nil {
+		t.Errorf("got %q (error: %v), expected %q", b, err, "new")
+	}
+	if fi, err := os.Stat(target); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected permissions of %s (error: %v)", target, err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Errorf("unexpected files in %s: %v (error: %v)", dir, entries, err)
+	}
+}
@@ -1,8 +1,7 @@
 package envsubst
 
 import (
-	"io/ioutil"
-	"os"
+	"io"
 
 	"github.com/a8m/envsubst/parse"
 )
@@ -18,13 +17,18 @@ func String(s string) (string, error) {
 // an error describing the failure.
 // Errors on first failure or returns a collection of failures if failOnFirst is false
 func StringRestricted(s string, noUnset, noEmpty bool) (string, error) {
-	return StringRestrictedNoDigit(s, noUnset, noEmpty , false)
+	return StringRestrictedNoDigit(s, noUnset, noEmpty, false)
 }
 
 // Like StringRestricted but additionally allows to ignore env variables which start with a digit.
 func StringRestrictedNoDigit(s string, noUnset, noEmpty bool, noDigit bool) (string, error) {
-	return parse.New("string", os.Environ(),
-		&parse.Restrictions{noUnset, noEmpty, noDigit}).Parse(s)
+	return Eval(s, restrict(noUnset, noEmpty, noDigit))
+}
+
+// StringFrom is like String but reads the variables from src instead of the
+// process environment.
+func StringFrom(s string, src parse.Lookuper) (string, error) {
+	return Eval(s, WithSource(src))
 }
 
 // Bytes returns the bytes represented by the parsed template after processing it.
@@ -42,12 +46,13 @@ func BytesRestricted(b []byte, noUnset, noEmpty bool) ([]byte, error) {
 
 // Like BytesRestricted but additionally allows to ignore env variables which start with a digit.
 func BytesRestrictedNoDigit(b []byte, noUnset, noEmpty bool, noDigit bool) ([]byte, error) {
-	s, err := parse.New("bytes", os.Environ(),
-		&parse.Restrictions{noUnset, noEmpty, noDigit}).Parse(string(b))
-	if err != nil {
-		return nil, err
-	}
-	return []byte(s), nil
+	return EvalBytes(b, restrict(noUnset, noEmpty, noDigit))
+}
+
+// BytesFrom is like Bytes but reads the variables from src instead of the
+// process environment.
+func BytesFrom(b []byte, src parse.Lookuper) ([]byte, error) {
+	return EvalBytes(b, WithSource(src))
 }
 
 // ReadFile call io.ReadFile with the given file name.
@@ -66,9 +71,45 @@ func ReadFileRestricted(filename string, noUnset, noEmpty bool) ([]byte, error)
 
 // Like ReadFileRestricted but additionally allows to ignore env variables which start with a digit.
 func ReadFileRestrictedNoDigit(filename string, noUnset, noEmpty bool, noDigit bool) ([]byte, error) {
-	b, err := ioutil.ReadFile(filename)
+	return EvalFile(filename, restrict(noUnset, noEmpty, noDigit))
+}
+
+// ReadFileFrom is like ReadFile but reads the variables from src instead of the
+// process environment.
+func ReadFileFrom(filename string, src parse.Lookuper) ([]byte, error) {
+	return EvalFile(filename, WithSource(src))
+}
+
+// NewReader returns a reader that substitutes the environment variables of the
+// input read from r as it is read, without loading the whole input in memory.
+// Reading fails with an error describing the failure if the input is invalid.
+// The substitution is configured by opts, as for Eval.
+func NewReader(r io.Reader, opts ...Option) io.Reader {
+	return NewParser("reader", opts...).NewReader(r)
+}
+
+// Copy substitutes the environment variables of the input read from r, as
+// NewReader does, and writes the result to w. It returns the number of bytes
+// written and the first error encountered, if any.
+func Copy(w io.Writer, r io.Reader, opts ...Option) (int64, error) {
+	return NewParser("copy", opts...).Copy(w, r)
+}
+
+// Parse parses the given template string without substituting it, and returns
+// its tree. The tree can be inspected to find the variables referenced by the
+// template, with their operators, default values and positions. The WithName,
+// NoDigit and Dotted options, and the Allow, Include and Exclude filters, which
+// keep the filtered references as text, affect the tree.
+func Parse(s string, opts ...Option) (*parse.Tree, error) {
+	return NewParser("string", opts...).Compile(s)
+}
+
+// Variables returns the names of the variables referenced by the template
+// string, in order of first appearance and without duplicates.
+func Variables(s string, opts ...Option) ([]string, error) {
+	t, err := Parse(s, opts...)
 	if err != nil {
 		return nil, err
 	}
-	return BytesRestrictedNoDigit(b, noUnset, noEmpty, noDigit)
+	return t.Variables(), nil
 }
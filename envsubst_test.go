@@ -3,7 +3,10 @@ package envsubst
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/a8m/envsubst/parse"
 )
 
 func init() {
@@ -28,3 +31,44 @@ func TestIntegration(t *testing.T) {
 		t.Error("Expect ReadFile integration test to pass")
 	}
 }
+
+func TestIntegrationStream(t *testing.T) {
+	input, expected := "foo $BAR", "foo bar"
+	out, err := ioutil.ReadAll(NewReader(strings.NewReader(input)))
+	if string(out) != expected || err != nil {
+		t.Error("Expect reader integration test to pass")
+	}
+	var b strings.Builder
+	n, err := Copy(&b, strings.NewReader(input))
+	if b.String() != expected || n != int64(len(expected)) || err != nil {
+		t.Error("Expect copy integration test to pass")
+	}
+}
+
+func TestIntegrationFrom(t *testing.T) {
+	src := parse.Map{"BAR": "baz"}
+	input, expected := "foo $BAR", "foo baz"
+	str, err := StringFrom(input, src)
+	if str != expected || err != nil {
+		t.Error("Expect string integration test to pass")
+	}
+	bytes, err := BytesFrom([]byte(input), src)
+	if string(bytes) != expected || err != nil {
+		t.Error("Expect bytes integration test to pass")
+	}
+	bytes, err = ReadFileFrom("testdata/file.tmpl", parse.LookupFunc(os.LookupEnv))
+	fexpected, err := ioutil.ReadFile("testdata/file.out")
+	if string(bytes) != string(fexpected) || err != nil {
+		t.Error("Expect ReadFile integration test to pass")
+	}
+}
+
+func TestIntegrationVariables(t *testing.T) {
+	names, err := Variables("${HOST:-localhost}:$PORT $HOST")
+	if err != nil || strings.Join(names, " ") != "HOST PORT" {
+		t.Errorf("unexpected variables %q, error: %v", names, err)
+	}
+	if _, err := Parse("${HOST"); err == nil {
+		t.Error("expected parse error")
+	}
+}
@@ -0,0 +1,177 @@
+package envsubst
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/a8m/envsubst/parse"
+)
+
+// Option configures the parsing and the evaluation of a template.
+type Option func(*options)
+
+type options struct {
+	name     string
+	src      parse.Lookuper
+	restrict parse.Restrictions
+	mode     parse.Mode
+	secrets  bool
+}
+
+// WithName sets the name of the template, as reported in errors.
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// WithEnv reads the variables from env, a list of "key=value" strings in the
+// form returned by os.Environ, instead of the process environment.
+func WithEnv(env []string) Option {
+	return func(o *options) {
+		o.src = parse.Env(env).Map()
+	}
+}
+
+// WithSource reads the variables from src instead of the process environment.
+func WithSource(src parse.Lookuper) Option {
+	return func(o *options) {
+		o.src = src
+	}
+}
+
+// NoUnset fails if a referenced variable is not set.
+func NoUnset() Option {
+	return func(o *options) {
+		o.restrict.NoUnset = true
+	}
+}
+
+// NoEmpty fails if a referenced variable is set but empty.
+func NoEmpty() Option {
+	return func(o *options) {
+		o.restrict.NoEmpty = true
+	}
+}
+
+// NoDigit leaves the variables starting with a digit, such as $1 and ${1},
+// unsubstituted.
+func NoDigit() Option {
+	return func(o *options) {
+		o.restrict.NoDigit = true
+	}
+}
+
+// Dotted allows dots in variable names, such as ${db.host}, to reference the
+// nested keys of the variables read by vars.ReadVars. Dots are allowed only in the
+// braced form, and a dot is part of a name only if followed by a name
+// character, so that bare references such as $HOST.example.com are unchanged.
+func Dotted() Option {
+	return func(o *options) {
+		o.restrict.Dotted = true
+	}
+}
+
+// Allow substitutes only the named variables. The other references are kept
+// as is, like GNU envsubst does with its SHELL-FORMAT argument.
+func Allow(names ...string) Option {
+	return func(o *options) {
+		o.restrict.Allow = append([]string{}, names...)
+	}
+}
+
+// Include substitutes only the variables matching one of the shell patterns,
+// such as APP_*. The other references are kept as is.
+func Include(patterns ...string) Option {
+	return func(o *options) {
+		o.restrict.Include = append(o.restrict.Include, patterns...)
+	}
+}
+
+// Exclude never substitutes the variables matching one of the shell patterns,
+// such as SECRET_*. Their references are kept as is.
+func Exclude(patterns ...string) Option {
+	return func(o *options) {
+		o.restrict.Exclude = append(o.restrict.Exclude, patterns...)
+	}
+}
+
+// AllErrors reports all the errors of the template instead of stopping at the
+// first one.
+func AllErrors() Option {
+	return func(o *options) {
+		o.mode = parse.AllErrors
+	}
+}
+
+// WithFileSecrets reads a variable NAME that is not set from the file named
+// by the variable NAME_FILE, following the Docker and Kubernetes convention
+// for secrets. See parse.FileSecrets.
+func WithFileSecrets() Option {
+	return func(o *options) {
+		o.secrets = true
+	}
+}
+
+// restrict sets the restrictions of the legacy boolean functions.
+func restrict(noUnset, noEmpty, noDigit bool) Option {
+	return func(o *options) {
+		o.restrict = parse.Restrictions{NoUnset: noUnset, NoEmpty: noEmpty, NoDigit: noDigit}
+	}
+}
+
+// newOptions returns the options of a parser named name, configured by opts.
+func newOptions(name string, opts []Option) *options {
+	o := &options{name: name}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// NewParser returns a parser named name configured by opts. Unless an option
+// sets the source of variables, it reads the process environment.
+func NewParser(name string, opts ...Option) *parse.Parser {
+	return newOptions(name, opts).parser()
+}
+
+// parser returns a parser configured by o.
+func (o *options) parser() *parse.Parser {
+	p := &parse.Parser{Name: o.name, Source: o.src, Restrict: &o.restrict, Mode: o.mode}
+	if p.Source == nil {
+		p.Env = os.Environ()
+	}
+	if o.secrets {
+		if p.Source == nil {
+			p.Source = p.Env.Map()
+		}
+		p.Source = parse.NewFileSecrets(p.Source)
+	}
+	return p
+}
+
+// Eval returns the template string after substituting its variables, as
+// configured by opts. By default, the variables are read from the process
+// environment, no restriction applies, and the first error is returned.
+func Eval(s string, opts ...Option) (string, error) {
+	return NewParser("string", opts...).Parse(s)
+}
+
+// EvalBytes is like Eval but takes and returns bytes.
+func EvalBytes(b []byte, opts ...Option) ([]byte, error) {
+	s, err := NewParser("bytes", opts...).Parse(string(b))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// EvalFile reads the named file and returns its content after substituting its
+// variables, as EvalBytes does.
+func EvalFile(filename string, opts ...Option) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return EvalBytes(b, append([]Option{WithName(filename)}, opts...)...)
+}
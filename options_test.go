@@ -0,0 +1,96 @@
+package envsubst
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/a8m/envsubst/parse"
+)
+
+var env = []string{"HOST=localhost", "EMPTY="}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		opts     []Option
+		expected string
+		err      string
+	}{
+		{"process env", "foo $BAR", nil, "foo bar", ""},
+		{"with env", "$HOST:${PORT:-80}", []Option{WithEnv(env)}, "localhost:80", ""},
+		{"with source", "$HOST", []Option{WithSource(parse.Map{"HOST": "example.com"})}, "example.com", ""},
+		{"no unset", "$HOST $PORT", []Option{WithEnv(env), NoUnset()}, "", "variable ${PORT} not set"},
+		{"no empty", "$EMPTY $PORT", []Option{WithEnv(env), NoEmpty()}, "", "variable ${EMPTY} set but empty"},
+		{"no digit", "$1 ${1}", []Option{WithEnv([]string{"1=one"}), NoDigit()}, "$1 ${1}", ""},
+		{"quick", "$EMPTY $PORT", []Option{WithEnv(env), NoUnset(), NoEmpty()}, "", "variable ${EMPTY} set but empty"},
+		{"all errors", "$EMPTY $PORT", []Option{WithEnv(env), NoUnset(), NoEmpty(), AllErrors()}, "",
+			"variable ${EMPTY} set but empty\nvariable ${PORT} not set"},
+	}
+	for _, test := range tests {
+		out, err := Eval(test.input, test.opts...)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if out != test.expected || err != nil {
+			t.Errorf("%s: got %q (error: %v), expected %q", test.name, out, err, test.expected)
+		}
+	}
+}
+
+func TestEvalName(t *testing.T) {
+	_, err := Eval("$PORT", WithEnv(env), WithName("config"), NoUnset())
+	var unset *parse.UnsetError
+	if !errors.As(err, &unset) || unset.Name != "config" {
+		t.Errorf("unexpected error %#v", err)
+	}
+	_, err = EvalFile("testdata/file.tmpl", WithEnv(nil), NoUnset())
+	if !errors.As(err, &unset) || unset.Name != "testdata/file.tmpl" {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestEvalStream(t *testing.T) {
+	out, err := ioutil.ReadAll(NewReader(strings.NewReader("$HOST"), WithEnv(env)))
+	if string(out) != "localhost" || err != nil {
+		t.Errorf("got %q (error: %v)", out, err)
+	}
+}
+
+func TestEvalFileSecrets(t *testing.T) {
+	src := parse.Map{"SECRET_FILE": "testdata/secret"}
+	out, err := Eval("$SECRET", WithSource(src), WithFileSecrets())
+	if out != "s3cr3t" || err != nil {
+		t.Errorf("got %q (error: %v)", out, err)
+	}
+	tmpl, err := Compile("$SECRET", WithFileSecrets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := tmpl.Execute(src); out != "s3cr3t" || err != nil {
+		t.Errorf("template: got %q (error: %v)", out, err)
+	}
+}
+
+func TestEvalAllow(t *testing.T) {
+	out, err := Eval("server_name $HOST; return 301 https://$host$request_uri;", WithEnv(env), Allow("HOST"))
+	if expected := "server_name localhost; return 301 https://$host$request_uri;"; out != expected || err != nil {
+		t.Errorf("got %q (error: %v), expected %q", out, err, expected)
+	}
+	if out, err := Eval("$HOST", WithEnv(env), Allow()); out != "$HOST" || err != nil {
+		t.Errorf("empty allowlist: got %q (error: %v)", out, err)
+	}
+}
+
+func TestEvalFilters(t *testing.T) {
+	src := parse.Map{"APP_HOST": "localhost", "APP_SECRET_KEY": "s3cr3t", "PATH": "/bin"}
+	out, err := Eval("$APP_HOST $APP_SECRET_KEY $PATH", WithSource(src), Include("APP_*"), Exclude("*SECRET*"))
+	if expected := "localhost $APP_SECRET_KEY $PATH"; out != expected || err != nil {
+		t.Errorf("got %q (error: %v), expected %q", out, err, expected)
+	}
+}
@@ -1,9 +1,74 @@
 package parse
 
 import (
+	"sort"
 	"strings"
 )
 
+// Lookuper is a source of variables.
+type Lookuper interface {
+	// Lookup retrieves the value of the variable named by name.
+	// The boolean reports whether the variable is set.
+	Lookup(name string) (string, bool)
+}
+
+// ErrLookuper is implemented by sources whose lookups can fail, such as
+// sources reading files. The parser uses LookupErr instead of Lookup, and
+// reports the errors.
+type ErrLookuper interface {
+	Lookuper
+	// LookupErr is like Lookup but returns the error of a failed lookup.
+	LookupErr(name string) (string, bool, error)
+}
+
+// lookupErr looks up the variable name in src, with LookupErr if src
+// implements ErrLookuper.
+func lookupErr(src Lookuper, name string) (string, bool, error) {
+	if l, ok := src.(ErrLookuper); ok {
+		return l.LookupErr(name)
+	}
+	v, ok := src.Lookup(name)
+	return v, ok, nil
+}
+
+// Keyer is implemented by sources that can list the names of their
+// variables. Sources that don't implement it expand to an empty
+// list in ${!prefix*}.
+type Keyer interface {
+	Keys() []string
+}
+
+// LookupFunc adapts an ordinary function, such as os.LookupEnv, to a Lookuper.
+type LookupFunc func(name string) (string, bool)
+
+func (f LookupFunc) Lookup(name string) (string, bool) {
+	return f(name)
+}
+
+// Map is a source of variables backed by a map.
+type Map map[string]string
+
+func (m Map) Lookup(name string) (string, bool) {
+	v, ok := m[name]
+	return v, ok
+}
+
+// Keys returns the sorted names of the variables in the map.
+func (m Map) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Env is a source of variables given as "KEY=value" pairs, such as
+// returned by os.Environ. If a key appears more than once, the last
+// pair wins.
+//
+// Lookups scan all pairs. Use Map to build an index when looking up
+// many variables.
 type Env []string
 
 func (e Env) Get(name string) string {
@@ -18,10 +83,198 @@ func (e Env) Has(name string) bool {
 
 func (e Env) Lookup(name string) (string, bool) {
 	prefix := name + "="
+	for i := len(e) - 1; i >= 0; i-- {
+		if strings.HasPrefix(e[i], prefix) {
+			return e[i][len(prefix):], true
+		}
+	}
+	return "", false
+}
+
+// Map returns an index of the environment. Later pairs override earlier
+// ones, and pairs without '=' are skipped.
+func (e Env) Map() Map {
+	m := make(Map, len(e))
 	for _, pair := range e {
-		if strings.HasPrefix(pair, prefix) {
-			return pair[len(prefix):], true
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			m[pair[:i]] = pair[i+1:]
+		}
+	}
+	return m
+}
+
+// Keys returns the names of the variables in the environment, without duplicates.
+func (e Env) Keys() []string {
+	seen := make(map[string]bool, len(e))
+	keys := make([]string, 0, len(e))
+	for _, pair := range e {
+		i := strings.IndexByte(pair, '=')
+		if i < 0 || seen[pair[:i]] {
+			continue
+		}
+		seen[pair[:i]] = true
+		keys = append(keys, pair[:i])
+	}
+	return keys
+}
+
+// Overlay is a mutable layer of variables on top of a source. Variables set in
+// the overlay, such as by ${var:=default}, shadow those of the source.
+type Overlay struct {
+	Source Lookuper
+	vars   map[string]string
+	keys   []string // assigned names, in order of first assignment
+}
+
+// NewOverlay returns an empty overlay on top of src.
+func NewOverlay(src Lookuper) *Overlay {
+	return &Overlay{Source: src, vars: make(map[string]string)}
+}
+
+func (o *Overlay) Get(name string) string {
+	v, _ := o.Lookup(name)
+	return v
+}
+
+func (o *Overlay) Has(name string) bool {
+	_, ok := o.Lookup(name)
+	return ok
+}
+
+func (o *Overlay) Lookup(name string) (string, bool) {
+	if v, ok := o.vars[name]; ok {
+		return v, true
+	}
+	return o.Source.Lookup(name)
+}
+
+func (o *Overlay) LookupErr(name string) (string, bool, error) {
+	if v, ok := o.vars[name]; ok {
+		return v, true, nil
+	}
+	return lookupErr(o.Source, name)
+}
+
+// Set assigns value to the variable name in the overlay.
+func (o *Overlay) Set(name, value string) {
+	if _, ok := o.vars[name]; !ok {
+		o.keys = append(o.keys, name)
+	}
+	o.vars[name] = value
+}
+
+// Keys returns the names of the variables in the source and the overlay,
+// without duplicates.
+func (o *Overlay) Keys() []string {
+	var keys []string
+	if k, ok := o.Source.(Keyer); ok {
+		keys = k.Keys()
+	}
+	for _, name := range o.keys {
+		if _, ok := o.Source.Lookup(name); !ok {
+			keys = append(keys, name)
 		}
 	}
+	return keys
+}
+
+// Assignments returns a copy of the variables set in the overlay.
+func (o *Overlay) Assignments() map[string]string {
+	m := make(map[string]string, len(o.vars))
+	for k, v := range o.vars {
+		m[k] = v
+	}
+	return m
+}
+
+// Precedence selects the layer of a Chain that supplies a variable set in
+// more than one layer.
+type Precedence int
+
+const (
+	FirstMatch Precedence = iota // the first layer setting the variable wins
+	LastMatch                    // the last layer setting the variable wins
+)
+
+// Layer is a named source of variables in a Chain. The name is reported by
+// Chain.Origin.
+type Layer struct {
+	Name   string
+	Source Lookuper
+}
+
+// Chain is a source of variables made of layers, such as a defaults file,
+// a .env file, the process environment and overrides, looked up in order
+// of precedence.
+type Chain struct {
+	Layers     []Layer
+	Precedence Precedence
+}
+
+// NewChain returns a chain of the given layers.
+func NewChain(p Precedence, layers ...Layer) *Chain {
+	return &Chain{Layers: layers, Precedence: p}
+}
+
+// Add appends a layer named name, reading the variables from src.
+func (c *Chain) Add(name string, src Lookuper) {
+	c.Layers = append(c.Layers, Layer{Name: name, Source: src})
+}
+
+func (c *Chain) Lookup(name string) (string, bool) {
+	v, i, _ := c.find(name)
+	return v, i >= 0
+}
+
+func (c *Chain) LookupErr(name string) (string, bool, error) {
+	v, i, err := c.find(name)
+	return v, i >= 0, err
+}
+
+// Origin returns the name of the layer supplying the variable name, and
+// false if no layer sets it.
+func (c *Chain) Origin(name string) (string, bool) {
+	if _, i, _ := c.find(name); i >= 0 {
+		return c.Layers[i].Name, true
+	}
 	return "", false
 }
+
+// find returns the value of the variable name and the index of the layer
+// supplying it, or -1. It stops at the first layer failing to look it up.
+func (c *Chain) find(name string) (string, int, error) {
+	for k := range c.Layers {
+		i := k
+		if c.Precedence == LastMatch {
+			i = len(c.Layers) - 1 - k
+		}
+		v, ok, err := lookupErr(c.Layers[i].Source, name)
+		if err != nil {
+			return "", -1, err
+		}
+		if ok {
+			return v, i, nil
+		}
+	}
+	return "", -1, nil
+}
+
+// Keys returns the names of the variables in the layers that implement
+// Keyer, without duplicates.
+func (c *Chain) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, l := range c.Layers {
+		k, ok := l.Source.(Keyer)
+		if !ok {
+			continue
+		}
+		for _, name := range k.Keys() {
+			if !seen[name] {
+				seen[name] = true
+				keys = append(keys, name)
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,113 @@
+package parse
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEnvDuplicates(t *testing.T) {
+	env := Env{"A=1", "B=2", "A=3", "NOEQUALS"}
+	for _, src := range []Lookuper{env, env.Map()} {
+		if v, ok := src.Lookup("A"); !ok || v != "3" {
+			t.Errorf("%T: expected last pair to win, got %q", src, v)
+		}
+		if _, ok := src.Lookup("NOEQUALS"); ok {
+			t.Errorf("%T: expected pair without '=' to be skipped", src)
+		}
+	}
+	if keys := env.Keys(); strings.Join(keys, ",") != "A,B" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+}
+
+func TestChain(t *testing.T) {
+	defaults := Map{"HOST": "localhost", "PORT": "80", "DEBUG": "false"}
+	team := Env{"PORT=8080", "USER=team"}
+	overrides := LookupFunc(func(name string) (string, bool) {
+		if name == "DEBUG" {
+			return "true", true
+		}
+		return "", false
+	})
+	tests := []struct {
+		precedence Precedence
+		name       string
+		value      string
+		origin     string
+	}{
+		{LastMatch, "HOST", "localhost", "defaults"},
+		{LastMatch, "PORT", "8080", "team"},
+		{LastMatch, "DEBUG", "true", "overrides"},
+		{FirstMatch, "PORT", "80", "defaults"},
+		{FirstMatch, "USER", "team", "team"},
+		{FirstMatch, "NOTSET", "", ""},
+	}
+	for _, test := range tests {
+		c := NewChain(test.precedence, Layer{"defaults", defaults}, Layer{"team", team})
+		c.Add("overrides", overrides)
+		v, ok := c.Lookup(test.name)
+		origin, found := c.Origin(test.name)
+		if v != test.value || ok != (test.origin != "") || origin != test.origin || found != ok {
+			t.Errorf("%v %s: got %q, %v from %q", test.precedence, test.name, v, ok, origin)
+		}
+	}
+	c := NewChain(LastMatch, Layer{"defaults", defaults}, Layer{"team", team}, Layer{"overrides", overrides})
+	if keys := c.Keys(); strings.Join(keys, ",") != "DEBUG,HOST,PORT,USER" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+}
+
+// benchEnv returns an environment of n variables and a template
+// referencing each of them refs times.
+func benchEnv(n, refs int) (Env, string) {
+	env := make(Env, n)
+	var b strings.Builder
+	for i := range env {
+		env[i] = fmt.Sprintf("VARIABLE_%d=value-%d", i, i)
+	}
+	for r := 0; r < refs; r++ {
+		for i := range env {
+			fmt.Fprintf(&b, "key: ${VARIABLE_%d}\n", i)
+		}
+	}
+	return env, b.String()
+}
+
+func BenchmarkEnvLookup(b *testing.B) {
+	env, _ := benchEnv(500, 0)
+	for i := 0; i < b.N; i++ {
+		env.Lookup("VARIABLE_499")
+	}
+}
+
+func BenchmarkMapLookup(b *testing.B) {
+	env, _ := benchEnv(500, 0)
+	m := env.Map()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Lookup("VARIABLE_499")
+	}
+}
+
+func BenchmarkParseIndexed(b *testing.B) {
+	env, text := benchEnv(500, 10)
+	p := New("bench", env, Relaxed)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Parse(text); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseUnindexed(b *testing.B) {
+	env, text := benchEnv(500, 10)
+	p := NewSource("bench", env, Relaxed)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Parse(text); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package parse
+
+import "fmt"
+
+// SyntaxError reports invalid input found while parsing a template.
+type SyntaxError struct {
+	Name   string // name of the template
+	Line   int    // line of the error, starting at 1
+	Column int    // byte column of the error, starting at 1
+	Msg    string // description of the error
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Msg
+}
+
+// UnsetError reports a reference to a variable that is not set, under the
+// NoUnset restriction or by the ${var?message} operators.
+type UnsetError struct {
+	Name     string // name of the template
+	Line     int    // line of the reference, starting at 1
+	Column   int    // byte column of the reference, starting at 1
+	Variable string // name of the variable
+	Msg      string // message of the ${var?message} operators, if any
+}
+
+func (e *UnsetError) Error() string {
+	if e.Msg != "" {
+		return e.Msg
+	}
+	return fmt.Sprintf("variable ${%s} not set", e.Variable)
+}
+
+// EmptyError reports a reference to a variable that is set but empty, under
+// the NoEmpty restriction or by the ${var:?message} operator.
+type EmptyError struct {
+	Name     string // name of the template
+	Line     int    // line of the reference, starting at 1
+	Column   int    // byte column of the reference, starting at 1
+	Variable string // name of the variable
+	Msg      string // message of the ${var:?message} operator, if any
+}
+
+func (e *EmptyError) Error() string {
+	if e.Msg != "" {
+		return e.Msg
+	}
+	return fmt.Sprintf("variable ${%s} set but empty", e.Variable)
+}
+
+// EvalError reports a failure to evaluate a reference to a variable, such as
+// a negative substring length, or a source of variables failing to read it.
+type EvalError struct {
+	Name     string // name of the template
+	Line     int    // line of the reference, starting at 1
+	Column   int    // byte column of the reference, starting at 1
+	Variable string // name of the variable
+	Err      error  // underlying error
+}
+
+func (e *EvalError) Error() string {
+	return fmt.Sprintf("variable ${%s}: %v", e.Variable, e.Err)
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
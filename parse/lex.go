@@ -33,16 +33,36 @@ const (
 	eof                = -1
 	itemError itemType = iota // error occurred; value is text of error
 	itemEOF
-	itemText        // plain text
-	itemPlus        // plus('+')
-	itemDash        // dash('-')
-	itemEquals      // equals
-	itemColonEquals // colon-equals (':=')
-	itemColonDash   // colon-dash(':-')
-	itemColonPlus   // colon-plus(':+')
-	itemVariable    // variable starting with '$', such as '$hello' or '$1'
-	itemLeftDelim   // left action delimiter '${'
-	itemRightDelim  // right action delimiter '}'
+	itemText          // plain text
+	itemPlus          // plus('+')
+	itemDash          // dash('-')
+	itemEquals        // equals
+	itemColonEquals   // colon-equals (':=')
+	itemColonDash     // colon-dash(':-')
+	itemColonPlus     // colon-plus(':+')
+	itemVariable      // variable starting with '$', such as '$hello' or '$1'
+	itemLeftDelim     // left action delimiter '${'
+	itemRightDelim    // right action delimiter '}'
+	itemLength        // length operator '#' as in '${#var}'
+	itemColon         // colon(':') starting a substring expansion or separating its arguments
+	itemNumber        // numeric argument of a substring expansion
+	itemHash          // hash('#'), remove shortest matching prefix
+	itemDoubleHash    // double-hash('##'), remove longest matching prefix
+	itemPercent       // percent('%'), remove shortest matching suffix
+	itemDoublePercent // double-percent('%%'), remove longest matching suffix
+	itemSlash         // slash('/'), replace first match of pattern
+	itemDoubleSlash   // double-slash('//'), replace all matches of pattern
+	itemSlashHash     // slash-hash('/#'), replace match of pattern at the beginning
+	itemSlashPercent  // slash-percent('/%'), replace match of pattern at the end
+	itemSeparator     // slash('/') separating pattern and replacement
+	itemCaret         // caret('^'), convert first character to uppercase
+	itemDoubleCaret   // double-caret('^^'), convert all characters to uppercase
+	itemComma         // comma(','), convert first character to lowercase
+	itemDoubleComma   // double-comma(',,'), convert all characters to lowercase
+	itemQuestion      // question('?'), fail if not set
+	itemColonQuestion // colon-question(':?'), fail if not set or empty
+	itemBang          // bang('!') for indirect expansion as in '${!var}'
+	itemNames         // star('*') or at('@') for prefix listing as in '${!prefix*}'
 )
 
 var tokens = map[itemType]string{
@@ -57,17 +77,21 @@ var tokens = map[itemType]string{
 // stateFn represents the state of the lexer as a function that returns the next state.
 type stateFn func(*lexer) stateFn
 
-// lexer holds the state of the scanner
+// lexer holds the state of the scanner. It runs synchronously: the state
+// functions are driven by nextItem until an item is available.
 type lexer struct {
-	input     string    // the string being lexed
-	state     stateFn   // the next lexing function to enter
-	pos       Pos       // current position in the input
-	start     Pos       // start position of this item
-	width     Pos       // width of last rune read from input
-	lastPos   Pos       // position of most recent item returned by nextItem
-	items     chan item // channel of lexed items
-	subsDepth int       // depth of substitution
-	noDigit   bool      // if the lexer skips variables that start with a digit
+	input     string  // the string being lexed
+	state     stateFn // the next lexing function to enter
+	pos       Pos     // current position in the input
+	start     Pos     // start position of this item
+	width     Pos     // width of last rune read from input
+	lastPos   Pos     // position of most recent item emitted
+	items     []item  // items emitted and not yet returned by nextItem
+	subsDepth int     // depth of substitution
+	sepDepths []int   // depths of the substitutions awaiting a pattern separator
+	repDepths []int   // depths of the substitutions scanning their replacement
+	noDigit   bool    // if the lexer skips variables that start with a digit
+	dotted    bool    // if variable names may contain dots, such as ${db.host}
 }
 
 // next returns the next rune in the input.
@@ -94,9 +118,9 @@ func (l *lexer) backup() {
 	l.pos -= l.width
 }
 
-// emit passes an item back to the client.
+// emit queues an item to be returned to the client.
 func (l *lexer) emit(t itemType) {
-	l.items <- item{t, l.start, l.input[l.start:l.pos]}
+	l.items = append(l.items, item{t, l.start, l.input[l.start:l.pos]})
 	l.lastPos = l.start
 	l.start = l.pos
 }
@@ -109,34 +133,33 @@ func (l *lexer) ignore() {
 // errorf returns an error token and terminates the scan by passing
 // back a nil pointer that will be the next state, terminating l.nextItem.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{itemError, l.start, fmt.Sprintf(format, args...)}
+	l.items = append(l.items, item{itemError, l.start, fmt.Sprintf(format, args...)})
 	return nil
 }
 
-// nextItem returns the next item from the input.
-// Called by the parser, not in the lexing goroutine.
+// nextItem returns the next item from the input, running the state
+// machine until an item is emitted. Once the input is exhausted, or
+// an error occurred, it keeps returning EOF.
 func (l *lexer) nextItem() item {
-	item := <-l.items
+	for len(l.items) == 0 {
+		if l.state == nil {
+			return item{itemEOF, l.pos, ""}
+		}
+		l.state = l.state(l)
+	}
+	item := l.items[0]
+	l.items = l.items[1:]
 	return item
 }
 
 // lex creates a new scanner for the input string.
-func lex(input string, noDigit bool) *lexer {
-	l := &lexer{
+func lex(input string, noDigit, dotted bool) *lexer {
+	return &lexer{
 		input:   input,
-		items:   make(chan item),
+		state:   lexText,
 		noDigit: noDigit,
+		dotted:  dotted,
 	}
-	go l.run()
-	return l
-}
-
-// run runs the state machine for the lexer.
-func (l *lexer) run() {
-	for l.state = lexText; l.state != nil; {
-		l.state = l.state(l)
-	}
-	close(l.items)
 }
 
 // lexText scans until encountering with "$" or an opening action delimiter, "${".
@@ -194,17 +217,34 @@ func lexVariable(l *lexer) stateFn {
 	var r rune
 	for {
 		r = l.next()
+		if r == '.' && l.dotted && l.subsDepth > 0 && l.input[l.start] != '$' {
+			// a dot is part of the subject of a substitution, such as ${db.host},
+			// only if followed by a name character. Bare references, such as
+			// $HOST.example.com, keep their suffix.
+			if next, _ := utf8.DecodeRuneInString(l.input[l.pos:]); isAlphaNumeric(next) {
+				continue
+			}
+		}
 		if !isAlphaNumeric(r) {
 			l.backup()
 			break
 		}
 	}
 	if v := l.input[l.start:l.pos]; v == "_" || v == "$_" {
+		if l.subsDepth > 0 {
+			l.emit(itemText)
+			return lexSubstitution
+		}
 		return lexText
 	}
+	subject := l.input[l.start] != '$'
 	l.emit(itemVariable)
-	if l.subsDepth > 0 {
+	switch {
+	case l.subsDepth > 0 && subject:
 		return lexSubstitutionOperator
+	case l.subsDepth > 0:
+		// variable is part of the operator argument, such as '$b' in '${a:-$b}'.
+		return lexSubstitution
 	}
 	return lexText
 }
@@ -213,19 +253,78 @@ func lexVariable(l *lexer) stateFn {
 func lexSubstitutionOperator(l *lexer) stateFn {
 	switch r := l.next(); {
 	case r == '}':
-		l.subsDepth--
-		l.emit(itemRightDelim)
-		return lexText
+		return l.closeSubstitution()
 	case r == eof || isEndOfLine(r):
 		return l.errorf("closing brace expected")
 	case isAlphaNumeric(r) && strings.HasPrefix(l.input[l.lastPos:], "${"):
 		return lexVariable
+	case r == '#' && strings.HasPrefix(l.input[l.lastPos:], "${"):
+		if !l.isVariableStart(l.peek()) {
+			l.emit(itemText)
+			return lexSubstitution
+		}
+		l.emit(itemLength)
+		return lexVariable
+	case r == '!' && strings.HasPrefix(l.input[l.lastPos:], "${"):
+		if !l.isVariableStart(l.peek()) {
+			l.emit(itemText)
+			return lexSubstitution
+		}
+		l.emit(itemBang)
+		return lexVariable
+	case (r == '*' || r == '@') && l.peek() == '}' && l.lastPos > 0 && l.input[l.lastPos-1] == '!':
+		l.emit(itemNames)
+	case r == '#':
+		if l.peek() == '#' {
+			l.next()
+			l.emit(itemDoubleHash)
+		} else {
+			l.emit(itemHash)
+		}
+	case r == '%':
+		if l.peek() == '%' {
+			l.next()
+			l.emit(itemDoublePercent)
+		} else {
+			l.emit(itemPercent)
+		}
+	case r == '^':
+		if l.peek() == '^' {
+			l.next()
+			l.emit(itemDoubleCaret)
+		} else {
+			l.emit(itemCaret)
+		}
+	case r == ',':
+		if l.peek() == ',' {
+			l.next()
+			l.emit(itemDoubleComma)
+		} else {
+			l.emit(itemComma)
+		}
+	case r == '/':
+		switch l.peek() {
+		case '/':
+			l.next()
+			l.emit(itemDoubleSlash)
+		case '#':
+			l.next()
+			l.emit(itemSlashHash)
+		case '%':
+			l.next()
+			l.emit(itemSlashPercent)
+		default:
+			l.emit(itemSlash)
+		}
+		l.sepDepths = append(l.sepDepths, l.subsDepth)
 	case r == '+':
 		l.emit(itemPlus)
 	case r == '-':
 		l.emit(itemDash)
 	case r == '=':
 		l.emit(itemEquals)
+	case r == '?':
+		l.emit(itemQuestion)
 	case r == ':':
 		switch l.next() {
 		case '-':
@@ -234,30 +333,129 @@ func lexSubstitutionOperator(l *lexer) stateFn {
 			l.emit(itemColonEquals)
 		case '+':
 			l.emit(itemColonPlus)
+		case '?':
+			l.emit(itemColonQuestion)
+		default:
+			l.backup()
+			l.emit(itemColon)
+			return lexSubstring
 		}
 	}
 	return lexSubstitution
 }
 
+// lexSubstring scans the offset and length arguments of a substring expansion.
+// The leading ':' has been scanned.
+func lexSubstring(l *lexer) stateFn {
+	for {
+		switch r := l.next(); {
+		case r == eof || isEndOfLine(r):
+			return l.errorf("closing brace expected")
+		case r == ':':
+			l.backup()
+			l.emit(itemNumber)
+			l.next()
+			l.emit(itemColon)
+		case r == '}':
+			l.backup()
+			l.emit(itemNumber)
+			l.next()
+			return l.closeSubstitution()
+		}
+	}
+}
+
 // lexSubstitution scans the elements inside substitution delimiters.
 func lexSubstitution(l *lexer) stateFn {
 	switch r := l.next(); {
 	case r == '}':
-		l.subsDepth--
-		l.emit(itemRightDelim)
-		return lexText
+		return l.closeSubstitution()
 	case r == eof || isEndOfLine(r):
 		return l.errorf("closing brace expected")
 	case isAlphaNumeric(r) && strings.HasPrefix(l.input[l.lastPos:], "${"):
-		fallthrough
+		return lexVariable
+	case r == '$' && l.peek() == '{':
+		// nested substitution, such as '${b}' in '${a:-${b}}'.
+		l.next()
+		if l.noDigit && unicode.IsDigit(l.peek()) {
+			l.next()
+			l.emit(itemText)
+			break
+		}
+		l.subsDepth++
+		l.emit(itemLeftDelim)
+		return lexSubstitutionOperator
+	case r == '$' && l.peek() == '$':
+		// ignore the previous '$'.
+		l.ignore()
+		l.next()
+		l.emit(itemText)
+	case r == '$' && !l.isVariableStart(l.peek()):
+		// a lone '$' is kept as text.
+		l.emit(itemText)
 	case r == '$':
 		return lexVariable
+	case r == '/' && l.awaitingSeparator():
+		l.sepDepths = l.sepDepths[:len(l.sepDepths)-1]
+		l.repDepths = append(l.repDepths, l.subsDepth)
+		l.emit(itemSeparator)
+	case r == '\\' && l.inReplacement() && l.peek() != eof:
+		// a backslash escapes the next character of the replacement, as
+		// in bash, and is removed.
+		l.ignore()
+		l.next()
+		l.emit(itemText)
+	case r == '\\' && l.awaitingSeparator() && l.peek() == '/':
+		// escaped separator is kept as part of the pattern.
+		l.next()
+		l.emit(itemText)
 	default:
 		l.emit(itemText)
 	}
 	return lexSubstitution
 }
 
+// closeSubstitution emits the right delimiter of the current substitution
+// and returns to the state of the enclosing text or substitution.
+// The '}' has been scanned.
+func (l *lexer) closeSubstitution() stateFn {
+	if l.awaitingSeparator() {
+		l.sepDepths = l.sepDepths[:len(l.sepDepths)-1]
+	}
+	if l.inReplacement() {
+		l.repDepths = l.repDepths[:len(l.repDepths)-1]
+	}
+	l.subsDepth--
+	l.emit(itemRightDelim)
+	if l.subsDepth > 0 {
+		return lexSubstitution
+	}
+	return lexText
+}
+
+// awaitingSeparator reports whether the current substitution expects a
+// separator between its pattern and replacement.
+func (l *lexer) awaitingSeparator() bool {
+	n := len(l.sepDepths)
+	return n > 0 && l.sepDepths[n-1] == l.subsDepth
+}
+
+// inReplacement reports whether the current substitution is scanning the
+// replacement of a pattern substitution.
+func (l *lexer) inReplacement() bool {
+	n := len(l.repDepths)
+	return n > 0 && l.repDepths[n-1] == l.subsDepth
+}
+
+// isVariableStart reports whether r can start a variable name inside
+// substitution delimiters, honoring the noDigit option.
+func (l *lexer) isVariableStart(r rune) bool {
+	if l.noDigit && unicode.IsDigit(r) {
+		return false
+	}
+	return isAlphaNumeric(r)
+}
+
 // isEndOfLine reports whether r is an end-of-line character.
 func isEndOfLine(r rune) bool {
 	return r == '\r' || r == '\n'
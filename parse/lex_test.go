@@ -1,6 +1,7 @@
 package parse
 
 import (
+	"runtime"
 	"strings"
 	"testing"
 )
@@ -21,6 +22,8 @@ var (
 	tColPlus   = item{itemColonPlus, 0, ":+"}
 	tLeft      = item{itemLeftDelim, 0, "${"}
 	tRight     = item{itemRightDelim, 0, "}"}
+	tLength    = item{itemLength, 0, "#"}
+	tColon     = item{itemColon, 0, ":"}
 )
 
 var lexTests = []lexTest{
@@ -104,6 +107,254 @@ var lexTests = []lexTest{
 		{itemText, 0, " foo"},
 		tEOF,
 	}},
+	{"length", "bar ${#BAR}", []item{
+		{itemText, 0, "bar "},
+		tLeft,
+		tLength,
+		{itemVariable, 0, "BAR"},
+		tRight,
+		tEOF,
+	}},
+	{"length without variable", "${#}", []item{
+		tLeft,
+		{itemText, 0, "#"},
+		tRight,
+		tEOF,
+	}},
+	{"substring offset", "${BAR:1}", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		tColon,
+		{itemNumber, 0, "1"},
+		tRight,
+		tEOF,
+	}},
+	{"substring negative offset and length", "${BAR: -4:2}", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		tColon,
+		{itemNumber, 0, " -4"},
+		tColon,
+		{itemNumber, 0, "2"},
+		tRight,
+		tEOF,
+	}},
+	{"substring empty offset", "${BAR::2}", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		tColon,
+		{itemNumber, 0, ""},
+		tColon,
+		{itemNumber, 0, "2"},
+		tRight,
+		tEOF,
+	}},
+	{"substring closing brace error", "${BAR:1", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		tColon,
+		{itemError, 0, "closing brace expected"},
+	}},
+	{"remove prefix", "${BAR##*/}", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		{itemDoubleHash, 0, "##"},
+		{itemText, 0, "*"},
+		{itemText, 0, "/"},
+		tRight,
+		tEOF,
+	}},
+	{"remove suffix", "${BAR%.git}", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		{itemPercent, 0, "%"},
+		{itemText, 0, "."},
+		{itemText, 0, "g"},
+		{itemText, 0, "i"},
+		{itemText, 0, "t"},
+		tRight,
+		tEOF,
+	}},
+	{"replace", "${BAR/a\\/b/$FOO}", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		{itemSlash, 0, "/"},
+		{itemText, 0, "a"},
+		{itemText, 0, "\\/"},
+		{itemText, 0, "b"},
+		{itemSeparator, 0, "/"},
+		{itemVariable, 0, "$FOO"},
+		tRight,
+		tEOF,
+	}},
+	{"replace with escapes", "${BAR/a/\\/\\$FOO\\}}", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		{itemSlash, 0, "/"},
+		{itemText, 0, "a"},
+		{itemSeparator, 0, "/"},
+		{itemText, 0, "/"},
+		{itemText, 0, "$"},
+		{itemText, 0, "F"},
+		{itemText, 0, "O"},
+		{itemText, 0, "O"},
+		{itemText, 0, "}"},
+		tRight,
+		tEOF,
+	}},
+	{"replace all without replacement", "${BAR//a}", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		{itemDoubleSlash, 0, "//"},
+		{itemText, 0, "a"},
+		tRight,
+		tEOF,
+	}},
+	{"uppercase", "${BAR^^[ab]}", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		{itemDoubleCaret, 0, "^^"},
+		{itemText, 0, "["},
+		{itemText, 0, "a"},
+		{itemText, 0, "b"},
+		{itemText, 0, "]"},
+		tRight,
+		tEOF,
+	}},
+	{"lowercase", "${BAR,}", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		{itemComma, 0, ","},
+		tRight,
+		tEOF,
+	}},
+	{"error if not set", "${BAR?not set}", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		{itemQuestion, 0, "?"},
+		{itemText, 0, "n"},
+		{itemText, 0, "o"},
+		{itemText, 0, "t"},
+		{itemText, 0, " "},
+		{itemText, 0, "s"},
+		{itemText, 0, "e"},
+		{itemText, 0, "t"},
+		tRight,
+		tEOF,
+	}},
+	{"error if not set or empty", "${BAR:?}", []item{
+		tLeft,
+		{itemVariable, 0, "BAR"},
+		{itemColonQuestion, 0, ":?"},
+		tRight,
+		tEOF,
+	}},
+	{"indirect", "${!BAR}", []item{
+		tLeft,
+		{itemBang, 0, "!"},
+		{itemVariable, 0, "BAR"},
+		tRight,
+		tEOF,
+	}},
+	{"prefix listing", "${!BAR*} ${!BAR@}", []item{
+		tLeft,
+		{itemBang, 0, "!"},
+		{itemVariable, 0, "BAR"},
+		{itemNames, 0, "*"},
+		tRight,
+		{itemText, 0, " "},
+		tLeft,
+		{itemBang, 0, "!"},
+		{itemVariable, 0, "BAR"},
+		{itemNames, 0, "@"},
+		tRight,
+		tEOF,
+	}},
+	{"leading space in substitution", "${ A} and ${B}", []item{
+		tLeft,
+		{itemVariable, 0, " A"},
+		tRight,
+		{itemText, 0, " and "},
+		tLeft,
+		{itemVariable, 0, "B"},
+		tRight,
+		tEOF,
+	}},
+	{"leading symbol in substitution", "${.A}", []item{
+		tLeft,
+		{itemVariable, 0, ".A"},
+		tRight,
+		tEOF,
+	}},
+	{"nested substitution", "${A:-${B:-x}y}", []item{
+		tLeft,
+		{itemVariable, 0, "A"},
+		tColDash,
+		tLeft,
+		{itemVariable, 0, "B"},
+		tColDash,
+		{itemText, 0, "x"},
+		tRight,
+		{itemText, 0, "y"},
+		tRight,
+		tEOF,
+	}},
+	{"nested substitution in pattern", "${A/${B/x/y}/z}", []item{
+		tLeft,
+		{itemVariable, 0, "A"},
+		{itemSlash, 0, "/"},
+		tLeft,
+		{itemVariable, 0, "B"},
+		{itemSlash, 0, "/"},
+		{itemText, 0, "x"},
+		{itemSeparator, 0, "/"},
+		{itemText, 0, "y"},
+		tRight,
+		{itemSeparator, 0, "/"},
+		{itemText, 0, "z"},
+		tRight,
+		tEOF,
+	}},
+	{"nested closing brace error", "${A:-${B}", []item{
+		tLeft,
+		{itemVariable, 0, "A"},
+		tColDash,
+		tLeft,
+		{itemVariable, 0, "B"},
+		tRight,
+		{itemError, 0, "closing brace expected"},
+	}},
+	{"mixed word", "${URL:-http://$HOST:$PORT/api}", []item{
+		tLeft,
+		{itemVariable, 0, "URL"},
+		tColDash,
+		{itemText, 0, "h"},
+		{itemText, 0, "t"},
+		{itemText, 0, "t"},
+		{itemText, 0, "p"},
+		{itemText, 0, ":"},
+		{itemText, 0, "/"},
+		{itemText, 0, "/"},
+		{itemVariable, 0, "$HOST"},
+		{itemText, 0, ":"},
+		{itemVariable, 0, "$PORT"},
+		{itemText, 0, "/"},
+		{itemText, 0, "a"},
+		{itemText, 0, "p"},
+		{itemText, 0, "i"},
+		tRight,
+		tEOF,
+	}},
+	{"escaping in word", "${A:-$$B$}", []item{
+		tLeft,
+		{itemVariable, 0, "A"},
+		tColDash,
+		{itemText, 0, "$"},
+		{itemText, 0, "B"},
+		{itemText, 0, "$"},
+		tRight,
+		tEOF,
+	}},
 	{"closing brace error", "hello-${world", []item{
 		{itemText, 0, "hello-"},
 		tLeft,
@@ -122,6 +373,37 @@ var lexTests = []lexTest{
 		{itemText, 8, "{HOME}"},
 		tEOF,
 	}},
+	{"dots without dotted", "$db.host", []item{
+		{itemVariable, 0, "$db"},
+		{itemText, 0, ".host"},
+		tEOF,
+	}},
+	{"dotted $var", "$db.host.", []item{
+		{itemVariable, 0, "$db"},
+		{itemText, 0, ".host."},
+		tEOF,
+	}},
+	{"dotted ${var}", "${db.host:-$db.port}", []item{
+		tLeft,
+		{itemVariable, 0, "db.host"},
+		tColDash,
+		{itemVariable, 0, "$db"},
+		{itemText, 0, "."},
+		{itemText, 0, "p"},
+		{itemText, 0, "o"},
+		{itemText, 0, "r"},
+		{itemText, 0, "t"},
+		tRight,
+		tEOF,
+	}},
+	{"dotted double dot", "${a..b}", []item{
+		tLeft,
+		{itemVariable, 0, "a"},
+		{itemText, 0, ".."},
+		{itemText, 0, "b"},
+		tRight,
+		tEOF,
+	}},
 	{"no digit $1", "hello $1", []item{
 		{itemText, 0, "hello "},
 		{itemText, 7, "$1"},
@@ -139,6 +421,23 @@ var lexTests = []lexTest{
 		{itemText, 10, "}"},
 		tEOF,
 	}},
+	{"no digit ${#1}", "hello ${#1}", []item{
+		{itemText, 0, "hello "},
+		tLeft,
+		{itemText, 0, "#"},
+		{itemText, 0, "1"},
+		tRight,
+		tEOF,
+	}},
+	{"no digit in word", "${A:-$1}", []item{
+		tLeft,
+		{itemVariable, 0, "A"},
+		tColDash,
+		{itemText, 0, "$"},
+		{itemText, 0, "1"},
+		tRight,
+		tEOF,
+	}},
 	{"no digit ${2ABC}", "hello ${2ABC}", []item{
 		{itemText, 0, "hello "},
 		{itemText, 7, "${2"},
@@ -156,10 +455,33 @@ func TestLex(t *testing.T) {
 	}
 }
 
+func TestLexNoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		// the parser stops at the first error and abandons the lexer.
+		if _, err := New("leak", FakeEnv, Relaxed).Parse("${#BAR:-baz} ${FOO} $BAR"); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines leaked: %d before, %d after", before, after)
+	}
+}
+
+func TestLexEOFAfterError(t *testing.T) {
+	l := lex("${A", false, false)
+	for _, typ := range []itemType{itemLeftDelim, itemVariable, itemError, itemEOF, itemEOF} {
+		if item := l.nextItem(); item.typ != typ {
+			t.Fatalf("got %v, expected type %d", item, typ)
+		}
+	}
+}
+
 // collect gathers the emitted items into a slice.
 func collect(t *lexTest) (items []item) {
 	noDigit := strings.HasPrefix(t.name, "no digit")
-	l := lex(t.input, noDigit)
+	dotted := strings.HasPrefix(t.name, "dotted")
+	l := lex(t.input, noDigit, dotted)
 	for {
 		item := l.nextItem()
 		items = append(items, item)
@@ -1,14 +1,71 @@
 package parse
 
 import (
-	"fmt"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// Node is an element in the parse tree. Nodes are immutable once parsed,
+// and evaluated against a state, so a tree can be executed concurrently.
 type Node interface {
 	Type() NodeType
+	Position() Pos // byte position of start of node in the input text
+	// String evaluates the node on its own. Nodes implemented outside of this
+	// package are evaluated by String when their tree is executed.
 	String() (string, error)
 }
 
+// evaluator is implemented by the nodes of this package, which are evaluated
+// against the state of an execution.
+type evaluator interface {
+	eval(s *state) (string, error)
+}
+
+// eval evaluates the node n against the state s.
+func eval(n Node, s *state) (string, error) {
+	if e, ok := n.(evaluator); ok {
+		return e.eval(s)
+	}
+	return n.String()
+}
+
+// state holds the variables and restrictions of a single execution of a tree.
+type state struct {
+	vars     *Overlay
+	restrict *Restrictions
+	tree     *Tree // tree being executed, to locate errors
+}
+
+// newState returns the state of a node evaluated on its own by String.
+func newState(env Env, restrict *Restrictions) *state {
+	if restrict == nil {
+		restrict = &Restrictions{}
+	}
+	return &state{vars: NewOverlay(env.Map()), restrict: restrict, tree: &Tree{line: 1, col: 1}}
+}
+
+// unsetError returns an UnsetError for the variable v.
+func (s *state) unsetError(v *VariableNode, msg string) error {
+	line, col := s.tree.Location(v.Pos)
+	return &UnsetError{Name: s.tree.Name, Line: line, Column: col, Variable: v.displayName(s), Msg: msg}
+}
+
+// emptyError returns an EmptyError for the variable v.
+func (s *state) emptyError(v *VariableNode, msg string) error {
+	line, col := s.tree.Location(v.Pos)
+	return &EmptyError{Name: s.tree.Name, Line: line, Column: col, Variable: v.displayName(s), Msg: msg}
+}
+
+// evalError returns an EvalError for the variable named name, referenced by v.
+func (s *state) evalError(v *VariableNode, name string, err error) error {
+	line, col := s.tree.Location(v.Pos)
+	return &EvalError{Name: s.tree.Name, Line: line, Column: col, Variable: name, Err: err}
+}
+
 // NodeType identifies the type of a node.
 type NodeType int
 
@@ -18,90 +75,581 @@ func (t NodeType) Type() NodeType {
 	return t
 }
 
+// Position returns p itself and provides an easy default implementation
+// for embedding in a Node. Embedded in all non-trivial Nodes.
+func (p Pos) Position() Pos {
+	return p
+}
+
 const (
 	NodeText NodeType = iota
 	NodeSubstitution
 	NodeVariable
+	NodeLength
+	NodeSubstring
+	NodeNames
+	NodeList
 )
 
 type TextNode struct {
 	NodeType
+	Pos
 	Text string
 }
 
+// NewText returns a text node at position 0.
+//
+// Deprecated: use NewTextAt.
 func NewText(text string) *TextNode {
-	return &TextNode{NodeText, text}
+	return NewTextAt(0, text)
+}
+
+// NewTextAt returns a text node at the position pos.
+func NewTextAt(pos Pos, text string) *TextNode {
+	return &TextNode{NodeText, pos, text}
 }
 
 func (t *TextNode) String() (string, error) {
 	return t.Text, nil
 }
 
+func (t *TextNode) eval(s *state) (string, error) {
+	return t.Text, nil
+}
+
+// ListNode holds a sequence of nodes, such as the word of a substitution
+// operator. It evaluates to the concatenation of its nodes.
+type ListNode struct {
+	NodeType
+	Pos
+	Nodes []Node
+}
+
+func NewList(pos Pos) *ListNode {
+	return &ListNode{NodeType: NodeList, Pos: pos}
+}
+
+// String evaluates the nodes of the list on their own.
+//
+// Deprecated: execute the tree with Parser.Execute or Template.Execute.
+func (l *ListNode) String() (string, error) {
+	var b strings.Builder
+	for _, n := range l.Nodes {
+		v, err := n.String()
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
+
+func (l *ListNode) eval(s *state) (string, error) {
+	var b strings.Builder
+	for _, n := range l.Nodes {
+		v, err := eval(n, s)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
+
+// append adds n to the list, merging adjacent text nodes.
+func (l *ListNode) append(n Node) {
+	if t, ok := n.(*TextNode); ok && len(l.Nodes) > 0 {
+		if last, ok := l.Nodes[len(l.Nodes)-1].(*TextNode); ok {
+			last.Text += t.Text
+			return
+		}
+	}
+	l.Nodes = append(l.Nodes, n)
+}
+
+// node returns the list as a Node, or nil if the list is empty.
+func (l *ListNode) node() Node {
+	if len(l.Nodes) == 0 {
+		return nil
+	}
+	return l
+}
+
 type VariableNode struct {
 	NodeType
+	Pos
 	Ident    string
-	Env      Env
-	Restrict *Restrictions
+	Indirect bool          // Ident names the variable holding the name to expand, as in ${!var}
+	Env      Env           // environment of String, set by NewVariable
+	Restrict *Restrictions // restrictions of String, set by NewVariable
 }
 
+// NewVariable returns a variable evaluated by String against env and restrict.
+//
+// Deprecated: use NewVariableAt, and execute the tree with Parser.Execute or
+// Template.Execute.
 func NewVariable(ident string, env Env, restrict *Restrictions) *VariableNode {
-	return &VariableNode{NodeVariable, ident, env, restrict}
+	return &VariableNode{NodeType: NodeVariable, Ident: ident, Env: env, Restrict: restrict}
+}
+
+// NewVariableAt returns a variable referenced at the position pos.
+func NewVariableAt(pos Pos, ident string) *VariableNode {
+	return &VariableNode{NodeType: NodeVariable, Pos: pos, Ident: ident}
 }
 
+// String evaluates the variable against its Env and Restrict fields.
+//
+// Deprecated: execute the tree with Parser.Execute or Template.Execute.
 func (t *VariableNode) String() (string, error) {
-	if err := t.validateNoUnset(); err != nil {
+	return t.eval(newState(t.Env, t.Restrict))
+}
+
+func (t *VariableNode) eval(s *state) (string, error) {
+	value, set, err := t.lookup(s)
+	if err != nil {
 		return "", err
 	}
-	value := t.Env.Get(t.Ident)
-	if err := t.validateNoEmpty(value); err != nil {
+	if err := t.validateNoUnset(s, set); err != nil {
+		return "", err
+	}
+	if err := t.validateNoEmpty(s, value, set); err != nil {
 		return "", err
 	}
 	return value, nil
 }
 
-func (t *VariableNode) isSet() bool {
-	return t.Env.Has(t.Ident)
+// errFiltered is returned when an indirect reference resolves to a variable
+// that is not substituted. The expression holding it is kept as is.
+var errFiltered = errors.New("variable filtered")
+
+// name returns the name of the variable to expand, resolving indirection.
+func (t *VariableNode) name(s *state) (string, error) {
+	if !t.Indirect {
+		return t.Ident, nil
+	}
+	name, _, err := s.vars.LookupErr(t.Ident)
+	if err != nil {
+		return "", s.evalError(t, t.Ident, err)
+	}
+	if name != "" && !s.restrict.substitutes(name) {
+		return "", errFiltered
+	}
+	return name, nil
+}
+
+// displayName returns the name of the variable to expand as it is shown in errors.
+func (t *VariableNode) displayName(s *state) string {
+	if name, _ := t.name(s); name != "" {
+		return name
+	}
+	return "!" + t.Ident
+}
+
+// lookup returns the value of the variable, and whether it is set. It fails
+// if the source of variables fails.
+func (t *VariableNode) lookup(s *state) (string, bool, error) {
+	name, err := t.name(s)
+	if err != nil {
+		return "", false, err
+	}
+	v, ok, err := s.vars.LookupErr(name)
+	if err != nil {
+		return "", false, s.evalError(t, name, err)
+	}
+	return v, ok, nil
 }
 
-func (t *VariableNode) validateNoUnset() error {
-	if t.Restrict.NoUnset && !t.isSet() {
-		return fmt.Errorf("variable ${%s} not set", t.Ident)
+func (t *VariableNode) validateNoUnset(s *state, set bool) error {
+	if s.restrict.NoUnset && !set {
+		return s.unsetError(t, "")
 	}
 	return nil
 }
 
-func (t *VariableNode) validateNoEmpty(value string) error {
-	if t.Restrict.NoEmpty && value == "" && t.isSet() {
-		return fmt.Errorf("variable ${%s} set but empty", t.Ident)
+func (t *VariableNode) validateNoEmpty(s *state, value string, set bool) error {
+	if s.restrict.NoEmpty && value == "" && set {
+		return s.emptyError(t, "")
 	}
 	return nil
 }
 
 type SubstitutionNode struct {
 	NodeType
+	Pos
 	ExpType  itemType
 	Variable *VariableNode
-	Default  Node // Default could be variable or text
+	Default  Node // Default word, if any. It holds the pattern for pattern operators
+	Replace  Node // Replacement word of pattern substitution operators, if any
+	end      Pos  // end of the expression in the input text
+}
+
+// operators maps the operator items to their text.
+var operators = map[itemType]string{
+	itemPlus:          "+",
+	itemDash:          "-",
+	itemEquals:        "=",
+	itemColonEquals:   ":=",
+	itemColonDash:     ":-",
+	itemColonPlus:     ":+",
+	itemHash:          "#",
+	itemDoubleHash:    "##",
+	itemPercent:       "%",
+	itemDoublePercent: "%%",
+	itemSlash:         "/",
+	itemDoubleSlash:   "//",
+	itemSlashHash:     "/#",
+	itemSlashPercent:  "/%",
+	itemCaret:         "^",
+	itemDoubleCaret:   "^^",
+	itemComma:         ",",
+	itemDoubleComma:   ",,",
+	itemQuestion:      "?",
+	itemColonQuestion: ":?",
 }
 
+// Operator returns the operator of the substitution as written in the
+// template, such as ":-" or "##", or "" for a plain ${var}.
+func (t *SubstitutionNode) Operator() string {
+	return operators[t.ExpType]
+}
+
+// String evaluates the expression against the Env and Restrict fields of
+// its variable.
+//
+// Deprecated: execute the tree with Parser.Execute or Template.Execute.
 func (t *SubstitutionNode) String() (string, error) {
+	return t.eval(newState(t.Variable.Env, t.Variable.Restrict))
+}
+
+func (t *SubstitutionNode) eval(s *state) (string, error) {
+	v, err := t.expand(s)
+	if err == errFiltered {
+		return s.tree.text[t.Pos:t.end], nil
+	}
+	return v, err
+}
+
+// expand evaluates the operator of the substitution.
+func (t *SubstitutionNode) expand(s *state) (string, error) {
+	switch t.ExpType {
+	case itemSlash, itemDoubleSlash, itemSlashHash, itemSlashPercent:
+		return t.replace(s)
+	case itemCaret, itemDoubleCaret, itemComma, itemDoubleComma:
+		return t.convertCase(s)
+	case itemQuestion, itemColonQuestion:
+		return t.require(s)
+	case itemEquals, itemColonEquals:
+		return t.assign(s)
+	}
 	if t.ExpType >= itemPlus && t.Default != nil {
 		switch t.ExpType {
-		case itemColonDash, itemColonEquals:
-			if s, _ := t.Variable.String(); s != "" {
-				return s, nil
+		case itemHash, itemDoubleHash, itemPercent, itemDoublePercent:
+			return t.remove(s)
+		}
+		v, set, err := t.Variable.lookup(s)
+		if err != nil {
+			return "", err
+		}
+		switch t.ExpType {
+		case itemColonDash:
+			if v != "" {
+				return v, nil
 			}
-			return t.Default.String()
+			return eval(t.Default, s)
 		case itemPlus, itemColonPlus:
-			if t.Variable.isSet() {
-				return t.Default.String()
+			if set {
+				return eval(t.Default, s)
 			}
 			return "", nil
 		default:
-			if !t.Variable.isSet() {
-				return t.Default.String()
+			if !set {
+				return eval(t.Default, s)
+			}
+		}
+	}
+	return t.Variable.eval(s)
+}
+
+// remove evaluates the pattern removal operators, such as ${var#pattern}.
+func (t *SubstitutionNode) remove(s *state) (string, error) {
+	value, err := t.Variable.eval(s)
+	if err != nil {
+		return "", err
+	}
+	pattern, err := eval(t.Default, s)
+	if err != nil {
+		return "", err
+	}
+	switch t.ExpType {
+	case itemHash, itemDoubleHash:
+		return trimPrefix(value, pattern, t.ExpType == itemDoubleHash), nil
+	default:
+		return trimSuffix(value, pattern, t.ExpType == itemDoublePercent), nil
+	}
+}
+
+// assign evaluates the assignment operators, such as ${var:=default}.
+// The default is assigned to the variable so that later references see it.
+func (t *SubstitutionNode) assign(s *state) (string, error) {
+	v, set, err := t.Variable.lookup(s)
+	if err != nil {
+		return "", err
+	}
+	if t.ExpType == itemColonEquals {
+		if v != "" {
+			return v, nil
+		}
+	} else if set {
+		return t.Variable.eval(s)
+	}
+	var value string
+	if t.Default != nil {
+		v, err := eval(t.Default, s)
+		if err != nil {
+			return "", err
+		}
+		value = v
+	}
+	if name, _ := t.Variable.name(s); name != "" {
+		s.vars.Set(name, value)
+	}
+	return value, nil
+}
+
+// replace evaluates the pattern substitution operators, such as ${var/pattern/string}.
+func (t *SubstitutionNode) replace(s *state) (string, error) {
+	value, err := t.Variable.eval(s)
+	if err != nil {
+		return "", err
+	}
+	var pattern, repl string
+	if t.Default != nil {
+		if pattern, err = eval(t.Default, s); err != nil {
+			return "", err
+		}
+	}
+	if t.Replace != nil {
+		if repl, err = eval(t.Replace, s); err != nil {
+			return "", err
+		}
+	}
+	idx := boundaries(value)
+	switch t.ExpType {
+	case itemSlashHash:
+		for k := len(idx) - 1; k >= 0; k-- {
+			if match(pattern, value[:idx[k]]) {
+				return repl + value[idx[k]:], nil
+			}
+		}
+		return value, nil
+	case itemSlashPercent:
+		for k := range idx {
+			if match(pattern, value[idx[k]:]) {
+				return value[:idx[k]] + repl, nil
 			}
 		}
+		return value, nil
+	}
+	if pattern == "" {
+		return value, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(idx)-1; {
+		// find the longest non-empty match starting at i.
+		end := -1
+		for k := len(idx) - 1; k > i; k-- {
+			if match(pattern, value[idx[i]:idx[k]]) {
+				end = k
+				break
+			}
+		}
+		if end < 0 {
+			b.WriteString(value[idx[i]:idx[i+1]])
+			i++
+			continue
+		}
+		b.WriteString(repl)
+		if t.ExpType == itemSlash {
+			b.WriteString(value[idx[end]:])
+			return b.String(), nil
+		}
+		i = end
+	}
+	return b.String(), nil
+}
+
+// convertCase evaluates the case modification operators, such as ${var^^}.
+// Only characters matching the pattern are converted, the default pattern
+// matches every character.
+func (t *SubstitutionNode) convertCase(s *state) (string, error) {
+	value, err := t.Variable.eval(s)
+	if err != nil {
+		return "", err
+	}
+	pattern := "?"
+	if t.Default != nil {
+		if pattern, err = eval(t.Default, s); err != nil {
+			return "", err
+		}
+	}
+	convert := unicode.ToUpper
+	if t.ExpType == itemComma || t.ExpType == itemDoubleComma {
+		convert = unicode.ToLower
+	}
+	all := t.ExpType == itemDoubleCaret || t.ExpType == itemDoubleComma
+	var b strings.Builder
+	for i, r := range value {
+		if (all || i == 0) && match(pattern, string(r)) {
+			r = convert(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), nil
+}
+
+// require evaluates the error-if-unset operators, such as ${var:?message}.
+// The message, if any, is used as the error text.
+func (t *SubstitutionNode) require(s *state) (string, error) {
+	value, set, err := t.Variable.lookup(s)
+	if err != nil {
+		return "", err
+	}
+	if set && (value != "" || t.ExpType == itemQuestion) {
+		return t.Variable.eval(s)
+	}
+	var msg string
+	if t.Default != nil {
+		v, err := eval(t.Default, s)
+		if err != nil {
+			return "", err
+		}
+		msg = v
+	}
+	if !set {
+		return "", s.unsetError(t.Variable, msg)
+	}
+	return "", s.emptyError(t.Variable, msg)
+}
+
+// LengthNode holds a string length expansion, such as ${#var}.
+type LengthNode struct {
+	NodeType
+	Pos
+	Variable *VariableNode
+}
+
+// String evaluates the expression against the Env and Restrict fields of
+// its variable.
+//
+// Deprecated: execute the tree with Parser.Execute or Template.Execute.
+func (t *LengthNode) String() (string, error) {
+	return t.eval(newState(t.Variable.Env, t.Variable.Restrict))
+}
+
+func (t *LengthNode) eval(s *state) (string, error) {
+	value, err := t.Variable.eval(s)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(utf8.RuneCountInString(value)), nil
+}
+
+// SubstringNode holds a substring expansion, such as ${var:offset} or
+// ${var:offset:length}. Offsets and lengths are counted in runes.
+type SubstringNode struct {
+	NodeType
+	Pos
+	Variable  *VariableNode
+	Offset    int
+	Length    int
+	HasLength bool
+	end       Pos // end of the expression in the input text
+}
+
+// String evaluates the expression against the Env and Restrict fields of
+// its variable.
+//
+// Deprecated: execute the tree with Parser.Execute or Template.Execute.
+func (t *SubstringNode) String() (string, error) {
+	return t.eval(newState(t.Variable.Env, t.Variable.Restrict))
+}
+
+func (t *SubstringNode) eval(s *state) (string, error) {
+	value, err := t.Variable.eval(s)
+	if err == errFiltered {
+		return s.tree.text[t.Pos:t.end], nil
+	}
+	if err != nil {
+		return "", err
+	}
+	runes := []rune(value)
+	n := len(runes)
+	start := t.Offset
+	if start < 0 {
+		start += n
+	}
+	if start < 0 || start > n {
+		return "", nil
+	}
+	end := n
+	if t.HasLength {
+		switch {
+		case t.Length < 0:
+			end = n + t.Length
+			if end < start {
+				return "", s.evalError(t.Variable, t.Variable.displayName(s), errors.New("substring expression < 0"))
+			}
+		case t.Length < n-start:
+			end = start + t.Length
+		}
+	}
+	return string(runes[start:end]), nil
+}
+
+// NamesNode holds a prefix listing, such as ${!prefix*}. It evaluates to the
+// sorted, space-separated names of the variables starting with the prefix.
+type NamesNode struct {
+	NodeType
+	Pos
+	Prefix string
+}
+
+// String evaluates the listing against an empty environment.
+//
+// Deprecated: execute the tree with Parser.Execute or Template.Execute.
+func (t *NamesNode) String() (string, error) {
+	return t.eval(newState(nil, nil))
+}
+
+func (t *NamesNode) eval(s *state) (string, error) {
+	var names []string
+	for _, name := range s.vars.Keys() {
+		if strings.HasPrefix(name, t.Prefix) && s.restrict.substitutes(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, " "), nil
+}
+
+// Inspect traverses the tree rooted at node in depth-first order, calling f
+// for each node. If f returns false, the children of the node are skipped.
+func Inspect(node Node, f func(Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+	switch n := node.(type) {
+	case *ListNode:
+		for _, c := range n.Nodes {
+			Inspect(c, f)
+		}
+	case *SubstitutionNode:
+		Inspect(n.Variable, f)
+		Inspect(n.Default, f)
+		Inspect(n.Replace, f)
+	case *LengthNode:
+		Inspect(n.Variable, f)
+	case *SubstringNode:
+		Inspect(n.Variable, f)
 	}
-	return t.Variable.String()
 }
@@ -3,6 +3,8 @@ package parse
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -20,27 +22,73 @@ type Restrictions struct {
 	NoUnset bool
 	NoEmpty bool
 	NoDigit bool
+	Dotted  bool // allow dots in variable names, such as ${db.host}
+	// Allow, if not nil, lists the only variables to substitute. The other
+	// references, such as $uri in an nginx configuration, are kept as is.
+	Allow []string
+	// Include and Exclude filter the variables to substitute by shell patterns,
+	// such as APP_*. If Include is not empty, only the variables matching one
+	// of its patterns are substituted, and the variables matching one of the
+	// patterns of Exclude never are. Filtered references are kept as is.
+	// Indirect references, such as ${!var}, are filtered by the name they
+	// resolve to, and ${!prefix*} lists only the substituted variables.
+	Include []string
+	Exclude []string
+}
+
+// substitutes reports whether references to the variable name are substituted.
+func (r *Restrictions) substitutes(name string) bool {
+	if r.Allow != nil && !contains(r.Allow, name) {
+		return false
+	}
+	if len(r.Include) > 0 && !matchAny(r.Include, name) {
+		return false
+	}
+	return !matchAny(r.Exclude, name)
+}
+
+// contains reports whether names contains name.
+func contains(names []string, name string) bool {
+	for _, v := range names {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether name matches one of the shell patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if match(pattern, name) {
+			return true
+		}
+	}
+	return false
 }
 
 // Restrictions specifier
 var (
-	Relaxed = &Restrictions{false, false, false}
-	NoEmpty = &Restrictions{false, true, false}
-	NoUnset = &Restrictions{true, false, false}
-	Strict  = &Restrictions{true, true, false}
+	Relaxed = &Restrictions{}
+	NoEmpty = &Restrictions{NoEmpty: true}
+	NoUnset = &Restrictions{NoUnset: true}
+	Strict  = &Restrictions{NoUnset: true, NoEmpty: true}
 )
 
 // Parser type initializer
 type Parser struct {
 	Name     string // name of the processing template
 	Env      Env
+	Source   Lookuper // source of variables, Env is used if nil
 	Restrict *Restrictions
 	Mode     Mode
+	// vars holds the variables assigned by the last call to Parse.
+	vars *Overlay
 	// parsing state;
 	lex       *lexer
 	token     [3]item // three-token lookahead
 	peekCount int
-	nodes     []Node
+	tree      *Tree
 }
 
 // New allocates a new Parser with the given name.
@@ -52,46 +100,144 @@ func New(name string, env []string, r *Restrictions) *Parser {
 	}
 }
 
+// NewSource allocates a new Parser with the given name that reads
+// variables from src.
+func NewSource(name string, src Lookuper, r *Restrictions) *Parser {
+	return &Parser{
+		Name:     name,
+		Source:   src,
+		Restrict: r,
+	}
+}
+
+// source returns the source of variables of the parser. Env is indexed
+// once, so that each reference is looked up in constant time.
+func (p *Parser) source() Lookuper {
+	if p.Source != nil {
+		return p.Source
+	}
+	return p.Env.Map()
+}
+
+// Tree is the representation of a single parsed template. A tree is never
+// modified once parsed, so it may be executed many times, concurrently.
+type Tree struct {
+	Name string    // name of the template
+	Root *ListNode // top-level nodes of the template
+	// parsing only; the input text, and the line and column at which it starts.
+	text      string
+	line, col int
+}
+
+// Location returns the line and the byte column, both starting at 1, of the
+// position pos in the input text of the tree.
+func (t *Tree) Location(pos Pos) (line, col int) {
+	if int(pos) > len(t.text) {
+		// nodes evaluated on their own by String have no input text.
+		pos = Pos(len(t.text))
+	}
+	text := t.text[:pos]
+	line = t.line + strings.Count(text, "\n")
+	if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+		return line, len(text) - i
+	}
+	return line, t.col + len(text)
+}
+
+// Variables returns the names of the variables referenced by the tree, in
+// order of first appearance and without duplicates. For an indirect reference,
+// such as ${!var}, the name of the variable holding the name is returned.
+func (t *Tree) Variables() []string {
+	var names []string
+	seen := make(map[string]bool)
+	Inspect(t.Root, func(n Node) bool {
+		if v, ok := n.(*VariableNode); ok && !seen[v.Ident] {
+			seen[v.Ident] = true
+			names = append(names, v.Ident)
+		}
+		return true
+	})
+	return names
+}
+
 // Parse parses the given string.
 func (p *Parser) Parse(text string) (string, error) {
-	p.lex = lex(text, p.Restrict.NoDigit)
 	// Build internal array of all unset or empty vars here
 	var errs []error
-	// clean parse state
-	p.nodes = make([]Node, 0)
-	p.peekCount = 0
-	if err := p.parse(); err != nil {
+	t, err := p.compile(text, 1, 1)
+	if err != nil {
 		switch p.Mode {
 		case Quick:
+			p.vars = nil
 			return "", err
 		case AllErrors:
 			errs = append(errs, err)
 		}
 	}
-	var out string
-	for _, node := range p.nodes {
-		s, err := node.String()
+	out, vars, err := p.execute(t, errs)
+	p.vars = vars
+	return out, err
+}
+
+// Compile parses the given string into a tree that can be executed many
+// times with Execute.
+func (p *Parser) Compile(text string) (*Tree, error) {
+	t, err := p.compile(text, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Execute evaluates the tree with the variables, restrictions and mode of the
+// parser. Unlike Parse, it does not modify the parser, so it is safe to call
+// Execute concurrently.
+func (p *Parser) Execute(t *Tree) (string, error) {
+	out, _, err := p.execute(t, nil)
+	return out, err
+}
+
+// compile parses text, starting at the given line and column of the input.
+// On error, it returns the nodes parsed so far.
+func (p *Parser) compile(text string, line, col int) (*Tree, error) {
+	p.lex = lex(text, p.Restrict.NoDigit, p.Restrict.Dotted)
+	// clean parse state
+	p.tree = &Tree{Name: p.Name, Root: NewList(0), text: text, line: line, col: col}
+	p.peekCount = 0
+	err := p.parse()
+	return p.tree, err
+}
+
+// execute evaluates the tree after the errors already encountered, if any,
+// and returns the output and the variables assigned during evaluation.
+func (p *Parser) execute(t *Tree, errs []error) (string, *Overlay, error) {
+	s := &state{vars: NewOverlay(p.source()), restrict: p.Restrict, tree: t}
+	var out strings.Builder
+	for _, node := range t.Root.Nodes {
+		v, err := eval(node, s)
 		if err != nil {
 			switch p.Mode {
 			case Quick:
-				return "", err
+				return "", s.vars, err
 			case AllErrors:
 				errs = append(errs, err)
 			}
 		}
-		out += s
+		out.WriteString(v)
 	}
 	if len(errs) > 0 {
-		var b strings.Builder
-		for i, err := range errs {
-			if i > 0 {
-				b.WriteByte('\n')
-			}
-			b.WriteString(err.Error())
-		}
-		return "", errors.New(b.String())
+		return "", s.vars, errors.Join(errs...)
+	}
+	return out.String(), s.vars, nil
+}
+
+// Assignments returns the variables assigned by the last call to Parse using
+// the ${var=default} and ${var:=default} operators.
+func (p *Parser) Assignments() map[string]string {
+	if p.vars == nil {
+		return map[string]string{}
 	}
-	return out, nil
+	return p.vars.Assignments()
 }
 
 // parse is the top-level parser for the template.
@@ -103,64 +249,202 @@ Loop:
 		case itemEOF:
 			break Loop
 		case itemError:
-			return p.errorf(t.val)
+			return p.errorf(t.pos, t.val)
 		case itemVariable:
-			varNode := NewVariable(strings.TrimPrefix(t.val, "$"), p.Env, p.Restrict)
-			p.nodes = append(p.nodes, varNode)
+			varNode := NewVariableAt(t.pos, strings.TrimPrefix(t.val, "$"))
+			p.tree.Root.append(p.keep(varNode))
 		case itemLeftDelim:
-			if p.peek().typ == itemVariable {
-				n, err := p.action()
+			if p.isAction() {
+				n, err := p.action(t.pos)
 				if err != nil {
 					return err
 				}
-				p.nodes = append(p.nodes, n)
+				p.tree.Root.append(p.keep(n))
 				continue
 			}
 			fallthrough
 		default:
-			textNode := NewText(t.val)
-			p.nodes = append(p.nodes, textNode)
+			textNode := NewTextAt(t.pos, t.val)
+			p.tree.Root.append(textNode)
 		}
 	}
 	return nil
 }
 
-// Parse substitution. first item is a variable.
-func (p *Parser) action() (Node, error) {
+// Parse substitution starting at pos. first item is a variable, a length or
+// an indirection operator.
+func (p *Parser) action(pos Pos) (Node, error) {
+	if p.peek().typ == itemLength {
+		return p.length(pos)
+	}
+	indirect := p.peek().typ == itemBang
+	if indirect {
+		p.next()
+	}
 	var expType itemType
-	var defaultNode Node
-	varNode := NewVariable(p.next().val, p.Env, p.Restrict)
+	defaultList, replList := NewList(0), NewList(0)
+	// word is the operator argument being parsed.
+	word := defaultList
+	// depth of the literal '${' in the word, which are not substitutions.
+	depth := 0
+	t := p.next()
+	varNode := NewVariableAt(t.pos, t.val)
+	varNode.Indirect = indirect
+	switch p.peek().typ {
+	case itemColon:
+		return p.substring(pos, varNode)
+	case itemNames:
+		p.next()
+		if t := p.next(); t.typ != itemRightDelim {
+			return nil, p.errorf(t.pos, "bad substitution")
+		}
+		return &NamesNode{NodeNames, pos, varNode.Ident}, nil
+	}
 Loop:
 	for {
 		switch t := p.next(); t.typ {
 		case itemRightDelim:
-			break Loop
+			if depth == 0 {
+				break Loop
+			}
+			depth--
+			word.append(NewTextAt(t.pos, t.val))
 		case itemError:
-			return nil, p.errorf(t.val)
+			return nil, p.errorf(t.pos, t.val)
+		case itemEOF:
+			return nil, p.errorf(t.pos, "closing brace expected")
+		case itemSeparator:
+			word = replList
+			word.Pos = t.pos + Pos(len(t.val))
 		case itemVariable:
-			defaultNode = NewVariable(strings.TrimPrefix(t.val, "$"), p.Env, p.Restrict)
-		case itemText:
-			n := NewText(t.val)
-		Text:
-			for {
-				switch p.peek().typ {
-				case itemRightDelim, itemError, itemEOF:
-					break Text
-				default:
-					// patch to accept all kind of chars
-					n.Text += p.next().val
+			word.append(p.keep(NewVariableAt(t.pos, strings.TrimPrefix(t.val, "$"))))
+		case itemLeftDelim:
+			if p.isAction() {
+				n, err := p.action(t.pos)
+				if err != nil {
+					return nil, err
 				}
+				word.append(p.keep(n))
+				continue
 			}
-			defaultNode = n
+			depth++
+			word.append(NewTextAt(t.pos, t.val))
+		case itemText:
+			word.append(NewTextAt(t.pos, t.val))
 		default:
 			expType = t.typ
+			word.Pos = t.pos + Pos(len(t.val))
 		}
 	}
-	return &SubstitutionNode{NodeSubstitution, expType, varNode, defaultNode}, nil
+	return &SubstitutionNode{NodeType: NodeSubstitution, Pos: pos, ExpType: expType, Variable: varNode,
+		Default: defaultList.node(), Replace: replList.node()}, nil
+}
+
+// keep returns n, the node just parsed, or a text node holding its source
+// text if the variable it references is not substituted. Indirect references
+// are resolved when evaluated, so their nodes record their end to be kept then.
+func (p *Parser) keep(n Node) Node {
+	// the last token consumed ends the node.
+	last := p.token[p.peekCount]
+	end := last.pos + Pos(len(last.val))
+	var v *VariableNode
+	switch n := n.(type) {
+	case *VariableNode:
+		v = n
+	case *SubstitutionNode:
+		v, n.end = n.Variable, end
+	case *LengthNode:
+		v = n.Variable
+	case *SubstringNode:
+		v, n.end = n.Variable, end
+	}
+	if v == nil || p.Restrict.substitutes(v.Ident) {
+		return n
+	}
+	return NewTextAt(n.Position(), p.lex.input[n.Position():end])
+}
+
+// isAction reports whether the next token starts a substitution
+// following a left delimiter.
+func (p *Parser) isAction() bool {
+	switch p.peek().typ {
+	case itemVariable, itemLength, itemBang:
+		return true
+	}
+	return false
+}
+
+// Parse string length expansion starting at pos. first item is the length operator.
+func (p *Parser) length(pos Pos) (Node, error) {
+	p.next()
+	t := p.next()
+	varNode := NewVariableAt(t.pos, t.val)
+	switch t = p.next(); t.typ {
+	case itemRightDelim:
+		return &LengthNode{NodeLength, pos, varNode}, nil
+	case itemError:
+		return nil, p.errorf(t.pos, t.val)
+	}
+	return nil, p.errorf(t.pos, "bad substitution")
+}
+
+// Parse substring expansion. next item is the colon following the variable.
+func (p *Parser) substring(pos Pos, varNode *VariableNode) (Node, error) {
+	p.next()
+	node := &SubstringNode{NodeType: NodeSubstring, Pos: pos, Variable: varNode}
+	t := p.next()
+	if t.typ == itemError {
+		return nil, p.errorf(t.pos, t.val)
+	}
+	offset, err := p.number("offset", t)
+	if err != nil {
+		return nil, err
+	}
+	node.Offset = offset
+	switch t2 := p.next(); t2.typ {
+	case itemError:
+		return nil, p.errorf(t2.pos, t2.val)
+	case itemRightDelim:
+		if strings.TrimSpace(t.val) == "" {
+			return nil, p.errorf(t.pos, "bad substitution")
+		}
+		return node, nil
+	}
+	t = p.next()
+	if t.typ == itemError {
+		return nil, p.errorf(t.pos, t.val)
+	}
+	if node.Length, err = p.number("length", t); err != nil {
+		return nil, err
+	}
+	node.HasLength = true
+	switch t = p.next(); t.typ {
+	case itemError:
+		return nil, p.errorf(t.pos, t.val)
+	case itemRightDelim:
+		return node, nil
+	}
+	return nil, p.errorf(t.pos, "bad substitution")
+}
+
+// number parses a numeric argument of a substring expansion. An empty argument
+// evaluates to 0.
+func (p *Parser) number(name string, t item) (int, error) {
+	s := strings.TrimSpace(t.val)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, p.errorf(t.pos, fmt.Sprintf("invalid substring %s %q", name, s))
+	}
+	return n, nil
 }
 
-func (p *Parser) errorf(s string) error {
-	return errors.New(s)
+// errorf returns a syntax error at pos in the template being parsed.
+func (p *Parser) errorf(pos Pos, msg string) error {
+	line, col := p.tree.Location(pos)
+	return &SyntaxError{Name: p.Name, Line: line, Column: col, Msg: msg}
 }
 
 // next returns the next token.
@@ -1,6 +1,10 @@
 package parse
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -10,6 +14,17 @@ var FakeEnv = []string{
 	"EMPTY=",
 	"ALSO_EMPTY=",
 	"A=AAA",
+	"UNICODE=héllo",
+	"SHA=0a1b2c3d4e5f",
+	"REPO=registry.example.com/team/app.git",
+	"BRANCH=feature/foo_bar-baz",
+	"MIXED=Hello World",
+	"UNICODE_UPPER=ÉCOLE",
+	"TARGET=BAR",
+	"TARGET_EMPTY=EMPTY",
+	"TARGET_NOTSET=NOTSET",
+	"HOST=localhost",
+	"PORT=8080",
 }
 
 type mode int
@@ -70,11 +85,143 @@ var parseTests = []parseTest{
 	{"gh-issue-41-3", "${NOTSET=-1}", "-1", errNone},
 	{"gh-issue-41-4", "${NOTSET:==1}", "=1", errNone},
 
+	// leading space or symbol in substitution
+	{"leading space 1", "${ A}", "", errUnset},
+	{"leading space 2", "${ A:-x} and ${BAR}", "x and bar", errNone},
+	{"leading symbol 1", "${.A}", "", errUnset},
+	{"leading symbol 2", "${@A}", "", errUnset},
+
 	// single letter
 	{"gh-issue-43-1", "${A}", "AAA", errNone},
 
+	// string length
+	{"length of $var", "${#BAR}", "3", errNone},
+	{"length of unicode $var", "${#UNICODE}", "5", errNone},
+	{"length without variable", "${#}", "${#}", errNone},
+
+	// substring
+	{"substring offset", "${SHA:4}", "2c3d4e5f", errNone},
+	{"substring offset and length", "${SHA:0:7}", "0a1b2c3", errNone},
+	{"substring negative offset", "${SHA: -4}", "4e5f", errNone},
+	{"substring negative offset and length", "${SHA: -4:2}", "4e", errNone},
+	{"substring negative length", "${SHA:2:-2}", "1b2c3d4e", errNone},
+	{"substring empty offset", "${SHA::2}", "0a", errNone},
+	{"substring empty length", "${SHA:2:}", "", errNone},
+	{"substring offset out of range", "${SHA:20}", "", errNone},
+	{"substring negative offset out of range", "${SHA: -20}", "", errNone},
+	{"substring length out of range", "${SHA:10:20}", "5f", errNone},
+	{"substring unicode", "${UNICODE:1:3}", "éll", errNone},
+	{"substring with spaces", "${SHA: 1 : 2 }", "a1", errNone},
+	{"substring does not shadow :-", "${NOTSET:-4}", "4", errNone},
+
+	// pattern removal
+	{"remove shortest prefix", "${REPO#*/}", "team/app.git", errNone},
+	{"remove longest prefix", "${REPO##*/}", "app.git", errNone},
+	{"remove shortest suffix", "${REPO%.git}", "registry.example.com/team/app", errNone},
+	{"remove longest suffix", "${REPO%%/*}", "registry.example.com", errNone},
+	{"remove shortest suffix glob", "${REPO%.*}", "registry.example.com/team/app", errNone},
+	{"remove longest suffix glob", "${REPO%%.*}", "registry", errNone},
+	{"remove prefix bracket", "${SHA#[0-9]?}", "1b2c3d4e5f", errNone},
+	{"remove prefix no match", "${REPO#foo}", "registry.example.com/team/app.git", errNone},
+	{"remove empty pattern", "${REPO%}", "registry.example.com/team/app.git", errNone},
+	{"remove prefix with $var pattern", "${BAR#$A}", "bar", errNone},
+	{"remove prefix of unicode", "${UNICODE#h?}", "llo", errNone},
+
+	// pattern substitution
+	{"replace first", "${BRANCH/_/-}", "feature/foo-bar-baz", errNone},
+	{"replace escaped separator", "${BRANCH/\\//-}", "feature-foo_bar-baz", errNone},
+	{"replace with escaped separator", "${MIXED//l/\\/}", "He//o Wor/d", errNone},
+	{"replace with escapes", "${BAR/a/\\$FOO\\}\\\\}", "b$FOO}\\r", errNone},
+	{"replace all", "${BRANCH//[\\/_]/-}", "feature-foo-bar-baz", errNone},
+	{"replace longest match", "${BRANCH/f*o/x}", "x_bar-baz", errNone},
+	{"replace prefix", "${BRANCH/#feature\\//}", "foo_bar-baz", errNone},
+	{"replace prefix no match", "${BRANCH/#foo/x}", "feature/foo_bar-baz", errNone},
+	{"replace suffix", "${BRANCH/%-baz/.local}", "feature/foo_bar.local", errNone},
+	{"replace with $var", "${BRANCH/foo/$BAR}", "feature/bar_bar-baz", errNone},
+	{"replace without replacement", "${BAR//a}", "br", errNone},
+	{"replace empty pattern", "${BAR//}", "bar", errNone},
+	{"replace empty prefix", "${BAR/#/x}", "xbar", errNone},
+	{"replace empty suffix", "${BAR/%/x}", "barx", errNone},
+	{"replace all with star", "${BAR//*/Z}", "Z", errNone},
+	{"replace unicode", "${UNICODE//l/L}", "héLLo", errNone},
+
+	// case modification
+	{"uppercase first", "${BAR^}", "Bar", errNone},
+	{"uppercase all", "${BAR^^}", "BAR", errNone},
+	{"lowercase first", "${MIXED,}", "hello World", errNone},
+	{"lowercase all", "${MIXED,,}", "hello world", errNone},
+	{"uppercase all matching pattern", "${MIXED^^[aeiou]}", "HEllO WOrld", errNone},
+	{"uppercase first not matching pattern", "${BAR^[!b]}", "bar", errNone},
+	{"uppercase all unicode", "${UNICODE^^}", "HÉLLO", errNone},
+	{"lowercase all unicode", "${UNICODE_UPPER,,}", "école", errNone},
+	{"uppercase empty", "${EMPTY^^}", "", errEmpty},
+
+	// error if not set
+	{"$var set ?", "${BAR?BAR is required}", "bar", errNone},
+	{"$var set :?", "${BAR:?BAR is required}", "bar", errNone},
+	{"$var not set ?", "${NOTSET?NOTSET is required}", "", errAll},
+	{"$var not set :?", "${NOTSET:?}", "", errAll},
+	{"$var set but empty ?", "${EMPTY?EMPTY is required}", "", errEmpty},
+	{"$var set but empty :?", "${EMPTY:?EMPTY is required}", "", errAll},
+	{"other vars stay optional", "${NOTSET?NOTSET is required} $ALSO_NOTSET", "", errAll},
+
+	// indirect expansion
+	{"indirect", "${!TARGET}", "bar", errNone},
+	{"indirect with operator", "${!TARGET^^}", "BAR", errNone},
+	{"indirect not set with default", "${!TARGET_NOTSET:-baz}", "baz", errNone},
+	{"indirect to empty", "${!TARGET_EMPTY}", "", errEmpty},
+	{"indirect to not set", "${!TARGET_NOTSET}", "", errUnset},
+	{"indirect pointer not set", "${!NOTSET}", "", errUnset},
+	{"prefix listing *", "${!TARGET*}", "TARGET TARGET_EMPTY TARGET_NOTSET", errNone},
+	{"prefix listing @", "${!TARGET_@}", "TARGET_EMPTY TARGET_NOTSET", errNone},
+	{"prefix listing no match", "${!NOTSET*}", "", errNone},
+	{"bang without variable", "${!}", "${!}", errNone},
+
+	// nested expressions
+	{"nested default", "${NOTSET:-${ALSO_NOTSET:-${EMPTY:-x}}}", "x", errNone},
+	{"nested default of set $var", "${NOTSET:-${BAR:-${FOO}}}", "bar", errNone},
+	{"nested default is lazy", "${BAR:-${NOTSET}}", "bar", errNone},
+	{"nested default not set", "${NOTSET:-${ALSO_NOTSET}}", "", errUnset},
+	{"nested default with text", "${NOTSET:-x${BAR}y}", "xbary", errNone},
+	{"nested default with operators", "${NOTSET:-${BAR^^}-${FOO:0:2}}", "BAR-fo", errNone},
+	{"nested alternate", "${BAR:+${FOO}}", "foo", errNone},
+	{"nested alternate is lazy", "${NOTSET+${ALSO_NOTSET}}", "", errNone},
+	{"nested pattern and replacement", "${BRANCH/${FOO//x/o}/${BAR/#/y}}", "feature/ybar_bar-baz", errNone},
+	{"nested invalid substitution", "${NOTSET:-${_}}", "${_}", errNone},
+	{"invalid var in default", "${NOTSET:-$_}", "$_", errNone},
+	{"nested closing brace expected", "${NOTSET:-${BAR}", "", errAll},
+
+	// mixed words
+	{"mixed default", "${URL:-http://$HOST:$PORT/api}", "http://localhost:8080/api", errNone},
+	{"mixed default with operators chars", "${URL:-$HOST-$PORT+x=y}", "localhost-8080+x=y", errNone},
+	{"mixed default with colon after $var", "${URL-$HOST:-x}", "localhost:-x", errNone},
+	{"mixed default of adjacent vars", "${URL:-$HOST$PORT}", "localhost8080", errNone},
+	{"mixed default with braces", "${URL:-${HOST}:$PORT}", "localhost:8080", errNone},
+	{"mixed alternate", "${BAR:+$HOST:$PORT}", "localhost:8080", errNone},
+	{"mixed replacement", "${BAR/a/-$FOO-}", "b-foo-r", errNone},
+	{"mixed error message", "${BAR:?$HOST is required}", "bar", errNone},
+	{"escape in default", "${URL:-a$$b}", "a$b", errNone},
+	{"lone $ in default", "${URL:-a$ b$}", "a$ b$", errNone},
+
+	// assignment
+	{"assigned $var :=", "${NOTSET:=foo} $NOTSET", "foo foo", errNone},
+	{"assigned $var =", "${NOTSET=foo}-${NOTSET}", "foo-foo", errNone},
+	{"assigned empty $var :=", "${EMPTY:=x} $EMPTY", "x x", errNone},
+	{"not assigned set $var =", "${EMPTY=x}$EMPTY", "", errEmpty},
+	{"assigned empty default", "${NOTSET:=}${NOTSET+set}", "set", errNone},
+	{"assigned in used branch", "${BAR:+${NOTSET:=x}}$NOTSET", "xx", errNone},
+	{"not assigned in unused branch", "${NOTSET+${ALSO_NOTSET:=x}}${ALSO_NOTSET:-y}", "y", errNone},
+	{"assigned indirect", "${!TARGET_NOTSET:=v} $NOTSET", "v v", errNone},
+	{"assigned listed", "${NOTSET_A:=1}${!NOTSET_*}", "1NOTSET_A", errNone},
+
 	// bad substitution
 	{"closing brace expected", "hello ${", "", errAll},
+	{"length with operator", "${#BAR:-baz}", "", errAll},
+	{"substring without offset", "${SHA:}", "", errAll},
+	{"substring invalid offset", "${SHA:abc}", "", errAll},
+	{"substring invalid length", "${SHA:1:x}", "", errAll},
+	{"substring too many arguments", "${SHA:1:2:3}", "", errAll},
+	{"substring negative length before offset", "${SHA:10:-4}", "", errAll},
 
 	// test specifically for failure modes
 	{"$var not set", "${NOTSET}", "", errUnset},
@@ -120,6 +267,12 @@ var parseTests = []parseTest{
 
 var negativeParseTests = []parseTest{
 	{"$NOTSET and EMPTY are displayed as in full error output", "${NOTSET} and $EMPTY", "variable ${NOTSET} not set\nvariable ${EMPTY} set but empty", errAllFull},
+	{"pattern removal of $NOTSET and EMPTY are displayed as in full error output", "${NOTSET#x} and ${EMPTY%%x}", "variable ${NOTSET} not set\nvariable ${EMPTY} set but empty", errAllFull},
+	{"pattern substitution of $NOTSET and EMPTY are displayed as in full error output", "${NOTSET/x/y} and ${EMPTY//x/$BAR}", "variable ${NOTSET} not set\nvariable ${EMPTY} set but empty", errAllFull},
+	{"case modification of $NOTSET and EMPTY are displayed as in full error output", "${NOTSET^^} and ${EMPTY,}", "variable ${NOTSET} not set\nvariable ${EMPTY} set but empty", errAllFull},
+	{"error if not set messages are displayed as in full error output", "${NOTSET:?NOTSET must point at the primary} ${EMPTY:?} ${FOO?}", "NOTSET must point at the primary\nvariable ${EMPTY} set but empty", errAllFull},
+	{"indirect $NOTSET and EMPTY are displayed as in full error output", "${!TARGET_NOTSET} and ${!TARGET_EMPTY} and ${!NOTSET}", "variable ${NOTSET} not set\nvariable ${EMPTY} set but empty\nvariable ${!NOTSET} not set", errAllFull},
+	{"length of $NOTSET and EMPTY are displayed as in full error output", "${#NOTSET} and ${#EMPTY}", "variable ${NOTSET} not set\nvariable ${EMPTY} set but empty", errAllFull},
 }
 
 func TestParse(t *testing.T) {
@@ -142,6 +295,51 @@ func TestParseStrictNoFailFast(t *testing.T) {
 	doNegativeAssertTest(t, strict)
 }
 
+func TestParseErrorIfNotSetQuick(t *testing.T) {
+	_, err := New("quick", FakeEnv, Relaxed).Parse("${NOTSET:?first} ${EMPTY:?second}")
+	if err == nil || err.Error() != "first" {
+		t.Errorf("expected error %q, got %v", "first", err)
+	}
+}
+
+func TestParseAssignments(t *testing.T) {
+	p := New("assignments", FakeEnv, Relaxed)
+	result, err := p.Parse("${NOTSET:=foo} ${BAR:=baz} ${EMPTY=x} ${ALSO_EMPTY:=$NOTSET}")
+	if err != nil || result != "foo bar  foo" {
+		t.Fatalf("unexpected result %q, error: %v", result, err)
+	}
+	got := p.Assignments()
+	expected := map[string]string{"NOTSET": "foo", "ALSO_EMPTY": "foo"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("assignments: got %v, expected %v", got, expected)
+	}
+	if _, err := p.Parse("$BAR"); err != nil || len(p.Assignments()) != 0 {
+		t.Errorf("expected assignments to be reset, got %v, error: %v", p.Assignments(), err)
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	sources := map[string]Lookuper{
+		"env":  Env(FakeEnv),
+		"map":  Map{"BAR": "bar", "EMPTY": "", "TARGET": "BAR"},
+		"func": LookupFunc(Map{"BAR": "bar", "EMPTY": "", "TARGET": "BAR"}.Lookup),
+	}
+	for name, src := range sources {
+		result, err := NewSource(name, src, Relaxed).Parse("$BAR ${!TARGET} ${EMPTY:-x} ${NOTSET:-y}")
+		if err != nil || result != "bar bar x y" {
+			t.Errorf("%s: unexpected result %q, error: %v", name, result, err)
+		}
+	}
+	result, _ := NewSource("map", Map{"B": "", "A": ""}, Relaxed).Parse("${!*}${!A*} ${!B*}")
+	if result != "${!*}A B" {
+		t.Errorf("map keys: unexpected result %q", result)
+	}
+	result, _ = NewSource("func", LookupFunc(Map{"A": ""}.Lookup), Relaxed).Parse("${!A*}")
+	if result != "" {
+		t.Errorf("func keys: unexpected result %q", result)
+	}
+}
+
 func doTest(t *testing.T, m mode) {
 	for _, test := range parseTests {
 		result, err := New(test.name, FakeEnv, restrict[m]).Parse(test.input)
@@ -169,3 +367,237 @@ func doNegativeAssertTest(t *testing.T, m mode) {
 		}
 	}
 }
+
+func TestCompile(t *testing.T) {
+	p := New("compile", FakeEnv, Strict)
+	tree, err := p.Compile("${NOTSET:=foo} ${BAR} $NOTSET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		result, err := p.Execute(tree)
+		if err != nil || result != "foo bar foo" {
+			t.Errorf("execution %d: unexpected result %q, error: %v", i, result, err)
+		}
+	}
+	if _, err := p.Compile("hello ${"); err == nil {
+		t.Error("expected compile error")
+	}
+}
+
+// upperNode is a node implemented outside of the package's node types.
+type upperNode struct {
+	NodeType
+	Pos
+	Text string
+}
+
+func (n *upperNode) String() (string, error) {
+	return strings.ToUpper(n.Text), nil
+}
+
+func TestNodeString(t *testing.T) {
+	v := NewVariable("BAR", FakeEnv, Strict)
+	if s, err := v.String(); s != "bar" || err != nil {
+		t.Errorf("got %q (error: %v), expected %q", s, err, "bar")
+	}
+	subs := &SubstitutionNode{NodeType: NodeSubstitution, ExpType: itemColonDash, Variable: NewVariable("NOTSET", FakeEnv, nil), Default: NewText("x")}
+	if s, err := subs.String(); s != "x" || err != nil {
+		t.Errorf("got %q (error: %v), expected %q", s, err, "x")
+	}
+	v = NewVariable("NOTSET", FakeEnv, Strict)
+	if _, err := v.String(); err == nil || err.Error() != "variable ${NOTSET} not set" {
+		t.Errorf("unexpected error %v", err)
+	}
+	p := New("custom", FakeEnv, Relaxed)
+	tree, err := p.Compile("$BAR ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Root.Nodes = append(tree.Root.Nodes, &upperNode{Text: "custom"})
+	if s, err := p.Execute(tree); s != "bar CUSTOM" || err != nil {
+		t.Errorf("got %q (error: %v), expected %q", s, err, "bar CUSTOM")
+	}
+}
+
+var variablesTests = []struct {
+	text string
+	want []string
+}{
+	{"no variables", nil},
+	{"$A ${B} $A", []string{"A", "B"}},
+	{"${A:-${B:-$C}}", []string{"A", "B", "C"}},
+	{"${A/$B/${C}}", []string{"A", "B", "C"}},
+	{"${#A} ${A:1:2} ${!B}", []string{"A", "B"}},
+	{"${!PRE*} $$A", nil},
+}
+
+func TestTreeVariables(t *testing.T) {
+	for _, test := range variablesTests {
+		tree, err := New("vars", nil, Relaxed).Compile(test.text)
+		if err != nil {
+			t.Fatalf("%q: %v", test.text, err)
+		}
+		if got := tree.Variables(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestTreePositions(t *testing.T) {
+	text := "a $A ${B:-x$C} $${D}"
+	tree, err := New("pos", nil, Relaxed).Compile(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	Inspect(tree.Root, func(n Node) bool {
+		switch n := n.(type) {
+		case *TextNode:
+			got = append(got, fmt.Sprintf("%d:text %q", n.Position(), n.Text))
+		case *VariableNode:
+			got = append(got, fmt.Sprintf("%d:var %s", n.Position(), n.Ident))
+		case *SubstitutionNode:
+			got = append(got, fmt.Sprintf("%d:subs %q", n.Position(), n.Operator()))
+		}
+		return true
+	})
+	want := []string{
+		`0:text "a "`,
+		`2:var A`,
+		`4:text " "`,
+		`5:subs ":-"`,
+		`7:var B`,
+		`10:text "x"`,
+		`11:var C`,
+		`14:text " ${D}"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseErrorTypes(t *testing.T) {
+	p := &Parser{Name: "errors", Env: FakeEnv, Restrict: Strict, Mode: AllErrors}
+	_, err := p.Parse("$BAR\n  ${NOTSET}\n$FOO${EMPTY:?empty!} ${!NOTSET}")
+	var unset *UnsetError
+	if !errors.As(err, &unset) || unset.Name != "errors" || unset.Variable != "NOTSET" || unset.Line != 2 || unset.Column != 5 {
+		t.Errorf("unexpected unset error %#v", unset)
+	}
+	var empty *EmptyError
+	if !errors.As(err, &empty) || empty.Variable != "EMPTY" || empty.Msg != "empty!" || empty.Line != 3 || empty.Column != 7 {
+		t.Errorf("unexpected empty error %#v", empty)
+	}
+	if want := "variable ${NOTSET} not set\nempty!\nvariable ${!NOTSET} not set"; err.Error() != want {
+		t.Errorf("got %q, want %q", err.Error(), want)
+	}
+	_, err = p.Parse("$BAR\n ${BAR:1:-3}")
+	var eval *EvalError
+	if !errors.As(err, &eval) || eval.Name != "errors" || eval.Variable != "BAR" || eval.Line != 2 || eval.Column != 4 {
+		t.Errorf("unexpected eval error %#v", eval)
+	}
+	if want := "variable ${BAR}: substring expression < 0"; err.Error() != want {
+		t.Errorf("got %q, want %q", err.Error(), want)
+	}
+
+	tests := []struct {
+		input     string
+		line, col int
+		msg       string
+	}{
+		{"${BAR", 1, 6, "closing brace expected"},
+		{"a\nb ${BAR:-x", 2, 11, "closing brace expected"},
+		{"a\n\t${SHA:x}", 2, 8, `invalid substring offset "x"`},
+		{"${#BAR:-x}", 1, 7, "bad substitution"},
+	}
+	for _, test := range tests {
+		_, err := New("syntax", FakeEnv, Relaxed).Parse(test.input)
+		var syntax *SyntaxError
+		if !errors.As(err, &syntax) || syntax.Name != "syntax" || syntax.Line != test.line || syntax.Column != test.col || syntax.Msg != test.msg {
+			t.Errorf("%q: unexpected syntax error %#v", test.input, syntax)
+		}
+	}
+}
+
+func TestParseDotted(t *testing.T) {
+	src := Map{"db.host": "localhost", "db": "postgres"}
+	tests := []struct {
+		restrict *Restrictions
+		input    string
+		expected string
+	}{
+		{Relaxed, "$db.host", "postgres.host"},
+		{&Restrictions{Dotted: true}, "${db.host} ${db.host:-none} ${db.port:-5432}.", "localhost localhost 5432."},
+		{&Restrictions{Dotted: true}, "$db. ${db}", "postgres. postgres"},
+		{&Restrictions{Dotted: true}, "$db.host $db.txt ${#db.host}", "postgres.host postgres.txt 9"},
+	}
+	for _, test := range tests {
+		out, err := NewSource("dotted", src, test.restrict).Parse(test.input)
+		if out != test.expected || err != nil {
+			t.Errorf("%q: got %q (error: %v), expected %q", test.input, out, err, test.expected)
+		}
+	}
+}
+
+func TestParseAllow(t *testing.T) {
+	tests := []struct {
+		allow    []string
+		input    string
+		expected string
+	}{
+		{nil, "$BAR ${FOO}", "bar foo"},
+		{[]string{}, "$BAR ${FOO}", "$BAR ${FOO}"},
+		{[]string{"BAR"}, "location / { try_files $uri $uri/ =404; } $BAR", "location / { try_files $uri $uri/ =404; } bar"},
+		{[]string{"BAR"}, "${FOO:-$BAR} ${#FOO} ${FOO:1} ${FOO/o/$BAR}", "${FOO:-$BAR} ${#FOO} ${FOO:1} ${FOO/o/$BAR}"},
+		{[]string{"NOTSET"}, "${NOTSET:-$BAR} ${NOTSET:-${FOO}x}", "$BAR ${FOO}x"},
+		{[]string{"FOO"}, "${!BAR} $$FOO", "${!BAR} $FOO"},
+		{[]string{"PTR"}, "${!PTR} $PTR", "${!PTR} BAR"},
+		{[]string{"PTR", "BAR"}, "${!PTR}", "bar"},
+	}
+	for _, test := range tests {
+		p := New("allow", append([]string{"PTR=BAR"}, FakeEnv...), &Restrictions{NoUnset: true, Allow: test.allow})
+		if out, err := p.Parse(test.input); out != test.expected || err != nil {
+			t.Errorf("%v %q: got %q (error: %v), expected %q", test.allow, test.input, out, err, test.expected)
+		}
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	tests := []struct {
+		include  []string
+		exclude  []string
+		input    string
+		expected string
+	}{
+		{nil, []string{"PATH", "HOME", "SECRET_*"}, "$BAR $PATH ${HOME:-x} $SECRET_KEY", "bar $PATH ${HOME:-x} $SECRET_KEY"},
+		{[]string{"B*"}, nil, "$BAR $FOO ${FOO:-$BAR}", "bar $FOO ${FOO:-$BAR}"},
+		{[]string{"[BF]*"}, []string{"FOO"}, "$BAR $FOO ${BRANCH}", "bar $FOO feature/foo_bar-baz"},
+		{[]string{"NOTSET"}, nil, "${NOTSET:-$BAR}", "$BAR"},
+	}
+	for _, test := range tests {
+		p := New("filters", FakeEnv, &Restrictions{Include: test.include, Exclude: test.exclude})
+		if out, err := p.Parse(test.input); out != test.expected || err != nil {
+			t.Errorf("%v %v %q: got %q (error: %v), expected %q", test.include, test.exclude, test.input, out, err, test.expected)
+		}
+	}
+}
+
+func TestParseFiltersIndirect(t *testing.T) {
+	src := Map{"SECRET_KEY": "hunter2", "SECRET_TOKEN": "t0k3n", "PTR": "SECRET_KEY", "APP": "PTR"}
+	restrict := &Restrictions{Exclude: []string{"SECRET_*"}}
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"${!PTR} $SECRET_KEY", "${!PTR} $SECRET_KEY"},
+		{"${!PTR:-x} ${!PTR:1:2} ${NOTSET:-${!PTR}}", "${!PTR:-x} ${!PTR:1:2} ${!PTR}"},
+		{"${!APP}", "SECRET_KEY"},
+		{"${!SECRET_*} ${!P*}", " PTR"},
+	}
+	for _, test := range tests {
+		out, err := NewSource("indirect", src, restrict).Parse(test.input)
+		if out != test.expected || err != nil {
+			t.Errorf("%q: got %q (error: %v), expected %q", test.input, out, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package parse
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// classes maps the POSIX character class names allowed in bracket expressions,
+// such as [[:alpha:]], to their predicates.
+var classes = map[string]func(rune) bool{
+	"alnum":  func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) },
+	"alpha":  unicode.IsLetter,
+	"blank":  func(r rune) bool { return r == ' ' || r == '\t' },
+	"cntrl":  unicode.IsControl,
+	"digit":  unicode.IsDigit,
+	"graph":  func(r rune) bool { return unicode.IsGraphic(r) && !unicode.IsSpace(r) },
+	"lower":  unicode.IsLower,
+	"print":  unicode.IsPrint,
+	"punct":  unicode.IsPunct,
+	"space":  unicode.IsSpace,
+	"upper":  unicode.IsUpper,
+	"xdigit": func(r rune) bool { return unicode.Is(unicode.ASCII_Hex_Digit, r) },
+}
+
+// match reports whether the entire s matches the shell pattern.
+// The pattern syntax is the one used by sh for pattern matching:
+//
+//	'*'         matches any sequence of characters, including '/'
+//	'?'         matches any single character
+//	'[' ... ']' matches a single character from the set, '!' or '^' negates
+//	'\\' c      matches character c
+func match(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); {
+				if match(pattern, s[i:]) {
+					return true
+				}
+				if i == len(s) {
+					break
+				}
+				_, w := utf8.DecodeRuneInString(s[i:])
+				i += w
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+			_, w := utf8.DecodeRuneInString(s)
+			s, pattern = s[w:], pattern[1:]
+			continue
+		case '[':
+			if s == "" {
+				return false
+			}
+			r, w := utf8.DecodeRuneInString(s)
+			if ok, rest, valid := matchClass(pattern, r); valid {
+				if !ok {
+					return false
+				}
+				s, pattern = s[w:], rest
+				continue
+			}
+			// an unterminated bracket expression matches a literal '['.
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+		}
+		pr, pw := utf8.DecodeRuneInString(pattern)
+		r, w := utf8.DecodeRuneInString(s)
+		if s == "" || pr != r {
+			return false
+		}
+		s, pattern = s[w:], pattern[pw:]
+	}
+	return s == ""
+}
+
+// matchClass matches r against the bracket expression at the start of
+// pattern. It returns whether r matched, the rest of the pattern after
+// the closing ']', and false if the bracket expression is not terminated.
+func matchClass(pattern string, r rune) (matched bool, rest string, valid bool) {
+	p := pattern[1:]
+	negate := false
+	if p != "" && (p[0] == '!' || p[0] == '^') {
+		negate = true
+		p = p[1:]
+	}
+	for first := true; ; first = false {
+		if p == "" {
+			return false, "", false
+		}
+		if p[0] == ']' && !first {
+			return matched != negate, p[1:], true
+		}
+		if len(p) > 1 && p[0] == '[' && p[1] == ':' {
+			if end := indexClassEnd(p[2:]); end >= 0 {
+				if fn, ok := classes[p[2:2+end]]; ok && fn(r) {
+					matched = true
+				}
+				p = p[2+end+2:]
+				continue
+			}
+		}
+		lo, w := decodeEscaped(p)
+		p = p[w:]
+		hi := lo
+		if len(p) > 1 && p[0] == '-' && p[1] != ']' {
+			hi, w = decodeEscaped(p[1:])
+			p = p[1+w:]
+		}
+		if lo <= r && r <= hi {
+			matched = true
+		}
+	}
+}
+
+// indexClassEnd returns the index of the ":]" closing a character class name, or -1.
+func indexClassEnd(s string) int {
+	for i := 0; i+1 < len(s); i++ {
+		switch {
+		case s[i] == ':' && s[i+1] == ']':
+			return i
+		case !unicode.IsLower(rune(s[i])):
+			return -1
+		}
+	}
+	return -1
+}
+
+// decodeEscaped decodes the first rune of s, honoring a leading backslash.
+func decodeEscaped(s string) (rune, int) {
+	if len(s) > 1 && s[0] == '\\' {
+		r, w := utf8.DecodeRuneInString(s[1:])
+		return r, w + 1
+	}
+	return utf8.DecodeRuneInString(s)
+}
+
+// boundaries returns the byte offsets of all rune boundaries in s, including len(s).
+func boundaries(s string) []int {
+	idx := make([]int, 0, len(s)+1)
+	for i := range s {
+		idx = append(idx, i)
+	}
+	return append(idx, len(s))
+}
+
+// trimPrefix removes the shortest, or the longest, prefix of s matching pattern.
+func trimPrefix(s, pattern string, longest bool) string {
+	idx := boundaries(s)
+	for k := range idx {
+		if longest {
+			k = len(idx) - 1 - k
+		}
+		if match(pattern, s[:idx[k]]) {
+			return s[idx[k]:]
+		}
+	}
+	return s
+}
+
+// trimSuffix removes the shortest, or the longest, suffix of s matching pattern.
+func trimSuffix(s, pattern string, longest bool) string {
+	idx := boundaries(s)
+	for k := range idx {
+		if !longest {
+			k = len(idx) - 1 - k
+		}
+		if match(pattern, s[idx[k]:]) {
+			return s[:idx[k]]
+		}
+	}
+	return s
+}
@@ -0,0 +1,40 @@
+package parse
+
+import "testing"
+
+var matchTests = []struct {
+	pattern string
+	s       string
+	match   bool
+}{
+	{"", "", true},
+	{"abc", "abc", true},
+	{"abc", "abd", false},
+	{"*", "", true},
+	{"*", "a/b/c", true},
+	{"a*c", "abbbc", true},
+	{"a*c", "abbbd", false},
+	{"*.git", "repo.git", true},
+	{"?", "é", true},
+	{"??", "a", false},
+	{"[abc]", "b", true},
+	{"[!abc]", "b", false},
+	{"[^abc]", "d", true},
+	{"[a-z]*", "hello", true},
+	{"[a-z]*", "Hello", false},
+	{"[]]", "]", true},
+	{"[[:digit:]]*", "1abc", true},
+	{"[[:upper:][:digit:]]", "a", false},
+	{"[a", "[a", true},
+	{"\\*", "*", true},
+	{"\\*", "a", false},
+	{"a\\", "a\\", true},
+}
+
+func TestMatch(t *testing.T) {
+	for _, test := range matchTests {
+		if got := match(test.pattern, test.s); got != test.match {
+			t.Errorf("match(%q, %q): got %v expected %v", test.pattern, test.s, got, test.match)
+		}
+	}
+}
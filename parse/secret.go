@@ -0,0 +1,91 @@
+package parse
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// DefaultMaxSecretSize is the maximum size of a secret file read by
+// FileSecrets, unless set otherwise.
+const DefaultMaxSecretSize = 1 << 20
+
+// FileSecrets is a source of variables following the Docker and Kubernetes
+// convention for secrets: a variable NAME that is not set in the source is
+// read from the file named by the variable NAME_FILE, if set. A trailing
+// newline is trimmed from the content of the file.
+type FileSecrets struct {
+	Source  Lookuper
+	MaxSize int64 // maximum size of a secret file, DefaultMaxSecretSize if 0
+}
+
+// NewFileSecrets returns a source reading the secrets named by the
+// variables of src.
+func NewFileSecrets(src Lookuper) *FileSecrets {
+	return &FileSecrets{Source: src}
+}
+
+func (f *FileSecrets) Lookup(name string) (string, bool) {
+	v, ok, err := f.LookupErr(name)
+	return v, ok && err == nil
+}
+
+// LookupErr looks up the variable name, and falls back to reading the file
+// named by NAME_FILE. It fails if the file can't be read or is too large.
+// Templates report the error as an EvalError naming the variable.
+func (f *FileSecrets) LookupErr(name string) (string, bool, error) {
+	if v, ok, err := lookupErr(f.Source, name); ok || err != nil {
+		return v, ok, err
+	}
+	path, ok, err := lookupErr(f.Source, name+"_FILE")
+	if !ok || path == "" || err != nil {
+		return "", false, err
+	}
+	v, err := ReadValue(path, f.MaxSize)
+	if err != nil {
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+// ReadValue returns the content of the file path, without the trailing
+// newline. It fails if the file is larger than max bytes, or than
+// DefaultMaxSecretSize if max is 0.
+func ReadValue(path string, max int64) (string, error) {
+	if max <= 0 {
+		max = DefaultMaxSecretSize
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	b, err := io.ReadAll(io.LimitReader(file, max+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(b)) > max {
+		return "", fmt.Errorf("file %s is larger than %d bytes", path, max)
+	}
+	s := strings.TrimSuffix(string(b), "\n")
+	return strings.TrimSuffix(s, "\r"), nil
+}
+
+// Keys returns the names of the variables of the source, and the names of
+// the secrets named by its NAME_FILE variables.
+func (f *FileSecrets) Keys() []string {
+	k, ok := f.Source.(Keyer)
+	if !ok {
+		return nil
+	}
+	keys := append([]string(nil), k.Keys()...)
+	for _, name := range keys {
+		if secret := strings.TrimSuffix(name, "_FILE"); secret != name && secret != "" {
+			if _, ok := f.Source.Lookup(secret); !ok {
+				keys = append(keys, secret)
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,56 @@
+package parse
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSecrets(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	src := NewFileSecrets(Map{
+		"DB_PASSWORD_FILE": write("db", "s3cr3t\n"),
+		"API_KEY_FILE":     write("api", "line1\nline2\r\n"),
+		"TOKEN":            "plain",
+		"TOKEN_FILE":       write("token", "from file"),
+		"LARGE_FILE":       write("large", strings.Repeat("x", 17)),
+		"MISSING_FILE":     filepath.Join(dir, "missing"),
+		"EMPTY_FILE":       "",
+	})
+	src.MaxSize = 16
+	tests := []struct {
+		input    string
+		expected string
+		err      string
+	}{
+		{"$DB_PASSWORD", "s3cr3t", ""},
+		{"${API_KEY}", "line1\nline2", ""},
+		{"$TOKEN", "plain", ""},
+		{"${EMPTY:-unset} ${NOTSET-unset}", "unset unset", ""},
+		{"${!DB_*}", "DB_PASSWORD DB_PASSWORD_FILE", ""},
+		{"$LARGE", "", "variable ${LARGE}: file " + filepath.Join(dir, "large") + " is larger than 16 bytes"},
+		{"${MISSING:-default}", "", "variable ${MISSING}: open " + filepath.Join(dir, "missing") + ": no such file or directory"},
+	}
+	for _, test := range tests {
+		out, err := NewSource("secrets", src, Relaxed).Parse(test.input)
+		if test.err != "" {
+			var eval *EvalError
+			if err == nil || err.Error() != test.err || !errors.As(err, &eval) || eval.Line != 1 {
+				t.Errorf("%q: got error %v, expected %q", test.input, err, test.err)
+			}
+			continue
+		}
+		if out != test.expected || err != nil {
+			t.Errorf("%q: got %q (error: %v), expected %q", test.input, out, err, test.expected)
+		}
+	}
+}
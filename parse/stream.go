@@ -0,0 +1,195 @@
+package parse
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// streamBufSize is the size of the input buffer of a reader. Lines longer
+// than the buffer are split between expressions.
+const streamBufSize = 64 << 10
+
+// reader substitutes the variables of its input as it is read.
+type reader struct {
+	p       Parser // private copy of the parser, holding the parse state
+	src     *bufio.Reader
+	s       *state
+	pending []byte  // input read but not parsed yet
+	out     []byte  // output not returned by Read yet
+	errs    []error // errors collected in AllErrors mode
+	err     error   // error returned once out is drained
+	// line and column at which the next chunk starts, to locate errors.
+	line, col int
+}
+
+// NewReader returns a reader that substitutes the variables of the input
+// read from r as it is read. The input is parsed line by line, and lines
+// longer than the internal buffer are split between expressions, so memory
+// use is bounded by the longest expression rather than by the input size.
+// Variables assigned by ${var:=default} are visible to the following lines.
+//
+// In Quick mode, reading stops at the line of the first error. In AllErrors
+// mode, the whole input is processed, expressions that failed evaluate to the
+// empty string, and the errors are returned at the end of the input.
+func (p *Parser) NewReader(r io.Reader) io.Reader {
+	return newReader(p, r, streamBufSize)
+}
+
+// Copy substitutes the variables of the input read from r, as NewReader
+// does, and writes the result to w. It returns the number of bytes written.
+func (p *Parser) Copy(w io.Writer, r io.Reader) (int64, error) {
+	return io.Copy(w, p.NewReader(r))
+}
+
+func newReader(p *Parser, r io.Reader, size int) *reader {
+	return &reader{
+		p:    Parser{Name: p.Name, Env: p.Env, Source: p.Source, Restrict: p.Restrict, Mode: p.Mode},
+		src:  bufio.NewReaderSize(r, size),
+		s:    &state{vars: NewOverlay(p.source()), restrict: p.Restrict},
+		line: 1,
+		col:  1,
+	}
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+	n := copy(b, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill parses and evaluates the next chunk of input.
+func (r *reader) fill() {
+	chunk, err := r.next()
+	if len(chunk) > 0 && !r.eval(string(chunk)) {
+		return
+	}
+	switch {
+	case err == io.EOF && len(r.errs) > 0:
+		r.err = errors.Join(r.errs...)
+	case err != nil:
+		r.err = err
+	}
+}
+
+// next returns the next chunk of input that can be parsed on its own: a line,
+// or the longest prefix of a long line that doesn't split an expression.
+func (r *reader) next() ([]byte, error) {
+	for {
+		line, err := r.src.ReadSlice('\n')
+		r.pending = append(r.pending, line...)
+		if err == bufio.ErrBufferFull {
+			i := safeCut(r.pending)
+			if i == 0 {
+				// the expression is longer than the buffer, keep reading.
+				continue
+			}
+			chunk := append([]byte(nil), r.pending[:i]...)
+			r.pending = append(r.pending[:0], r.pending[i:]...)
+			return chunk, nil
+		}
+		chunk := r.pending
+		r.pending = nil
+		return chunk, err
+	}
+}
+
+// eval parses and evaluates text, appending the output to r.out.
+// It reports whether processing should continue.
+func (r *reader) eval(text string) bool {
+	r.out = r.out[:0]
+	t, err := r.p.compile(text, r.line, r.col)
+	r.s.tree = t
+	r.advance(text)
+	if err != nil && !r.fail(err) {
+		return false
+	}
+	for _, node := range t.Root.Nodes {
+		v, err := eval(node, r.s)
+		if err != nil && !r.fail(err) {
+			return false
+		}
+		r.out = append(r.out, v...)
+	}
+	return true
+}
+
+// advance moves the location of the next chunk past text.
+func (r *reader) advance(text string) {
+	if n := strings.Count(text, "\n"); n > 0 {
+		r.line += n
+		r.col = len(text) - strings.LastIndexByte(text, '\n')
+		return
+	}
+	r.col += len(text)
+}
+
+// fail records err according to the parser mode. In Quick mode, the output
+// of the current chunk is discarded and processing stops.
+func (r *reader) fail(err error) bool {
+	if r.p.Mode == Quick {
+		r.out = r.out[:0]
+		r.err = err
+		return false
+	}
+	r.errs = append(r.errs, err)
+	return true
+}
+
+// safeCut returns the length of the longest prefix of b that doesn't end
+// inside an expression, such that the rest of b can be parsed on its own.
+func safeCut(b []byte) int {
+	for i := 0; i < len(b); {
+		if b[i] != '$' {
+			i++
+			continue
+		}
+		start := i
+		i++
+		switch {
+		case i == len(b):
+			return start
+		case b[i] == '$':
+			i++
+		case b[i] == '{':
+			i++
+			for depth := 1; depth > 0; i++ {
+				switch {
+				case i == len(b):
+					return start
+				case b[i] == '}':
+					depth--
+				case b[i] == '\\' && i+1 < len(b):
+					// an escaped '}' doesn't close the expression.
+					i++
+				case b[i] == '$' && i+1 < len(b) && (b[i+1] == '$' || b[i+1] == '{'):
+					if b[i+1] == '{' {
+						depth++
+					}
+					i++
+				}
+			}
+		default:
+			for {
+				if i == len(b) {
+					// the name may continue in the rest of the input.
+					return start
+				}
+				r, w := utf8.DecodeRune(b[i:])
+				if !isAlphaNumeric(r) {
+					break
+				}
+				i += w
+			}
+		}
+	}
+	return len(b)
+}
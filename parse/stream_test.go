@@ -0,0 +1,102 @@
+package parse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	for _, m := range []mode{relaxed, noUnset, noEmpty, strict} {
+		for _, test := range parseTests {
+			if test.hasErr[m] {
+				continue
+			}
+			var out bytes.Buffer
+			_, err := New(test.name, FakeEnv, restrict[m]).Copy(&out, strings.NewReader(test.input))
+			if err != nil || out.String() != test.expected {
+				t.Errorf("%s=(%q): got\n\t%q (error: %v)\nexpected\n\t%q", test.name, test.input, out.String(), err, test.expected)
+			}
+		}
+	}
+}
+
+func TestReaderLongLines(t *testing.T) {
+	input := strings.Repeat("${BAR} $$FOO ${NOTSET:-${FOO}} $A-", 20) + "\n${NOTSET:=set}\n$NOTSET"
+	expected, err := New("long", FakeEnv, Relaxed).Parse(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{16, 17, 31, 64} {
+		out, err := io.ReadAll(newReader(New("long", FakeEnv, Relaxed), strings.NewReader(input), size))
+		if err != nil || string(out) != expected {
+			t.Errorf("buffer size %d: got\n\t%q (error: %v)\nexpected\n\t%q", size, out, err, expected)
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	input := "$BAR\n${NOTSET}\n$FOO ${EMPTY}\n$A"
+	p := &Parser{Name: "errors", Env: FakeEnv, Restrict: Strict, Mode: Quick}
+	var out bytes.Buffer
+	if _, err := p.Copy(&out, strings.NewReader(input)); err == nil || err.Error() != "variable ${NOTSET} not set" {
+		t.Errorf("quick: unexpected error %v", err)
+	}
+	if out.String() != "bar\n" {
+		t.Errorf("quick: unexpected output %q", out.String())
+	}
+	p.Mode = AllErrors
+	out.Reset()
+	if _, err := p.Copy(&out, strings.NewReader(input)); err == nil || err.Error() != "variable ${NOTSET} not set\nvariable ${EMPTY} set but empty" {
+		t.Errorf("all errors: unexpected error %v", err)
+	}
+	if out.String() != "bar\n\nfoo \nAAA" {
+		t.Errorf("all errors: unexpected output %q", out.String())
+	}
+}
+
+func TestReaderErrorLocation(t *testing.T) {
+	input := "$BAR\n" + strings.Repeat("${BAR} ", 10) + "${NOTSET}\n$FOO ${EMPTY}"
+	p := &Parser{Name: "location", Env: FakeEnv, Restrict: Strict, Mode: AllErrors}
+	for _, size := range []int{16, 64} {
+		_, err := io.ReadAll(newReader(p, strings.NewReader(input), size))
+		var unset *UnsetError
+		if !errors.As(err, &unset) || unset.Line != 2 || unset.Column != 73 {
+			t.Errorf("buffer size %d: unexpected unset error %#v", size, unset)
+		}
+		var empty *EmptyError
+		if !errors.As(err, &empty) || empty.Line != 3 || empty.Column != 8 {
+			t.Errorf("buffer size %d: unexpected empty error %#v", size, empty)
+		}
+	}
+}
+
+func TestSafeCut(t *testing.T) {
+	tests := []struct {
+		input string
+		cut   int
+	}{
+		{"hello", 5},
+		{"hello $BAR", 6},
+		{"$BAR", 0},
+		{"$BAR baz", 8},
+		{"${BAR} baz", 10},
+		{"a ${BAR} b $$c", 14},
+		{"a ${BAR:-${FOO}} b", 18},
+		{"a ${BAR:-${FOO} b", 2},
+		{"a ${BAR:-$${FOO", 2},
+		{"a ${BAR/a/\\}", 2},
+		{"a ${BAR/a/\\", 2},
+		{"a ${BAR/a/\\}} b", 15},
+		{"a $$", 4},
+		{"a$", 1},
+		{"a $ébc", 2},
+	}
+	for _, test := range tests {
+		if cut := safeCut([]byte(test.input)); cut != test.cut {
+			t.Errorf("safeCut(%q): got %d, expected %d", test.input, cut, test.cut)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package envsubst
+
+import (
+	"os"
+
+	"github.com/a8m/envsubst/parse"
+)
+
+// Template is a compiled template. The template is parsed once by Compile,
+// and can then be executed many times, concurrently, with different sources
+// of variables.
+type Template struct {
+	parser  parse.Parser
+	tree    *parse.Tree
+	src     parse.Lookuper // source set by the options of Compile, if any
+	secrets bool           // compiled WithFileSecrets
+}
+
+// Compile parses the given template string. The restrictions and the mode of
+// the template are configured by opts, as for Eval, and its source of variables
+// is given to Execute.
+// If the parser encounters invalid input, it returns an error describing the failure.
+func Compile(s string, opts ...Option) (*Template, error) {
+	o := newOptions("template", opts)
+	t := &Template{parser: *o.parser(), src: o.src, secrets: o.secrets}
+	tree, err := t.parser.Compile(s)
+	if err != nil {
+		return nil, err
+	}
+	t.tree = tree
+	return t, nil
+}
+
+// Execute returns the template string after substituting the variables read from env.
+// If env is nil, the variables are read from the source set by the WithEnv
+// or WithSource options of Compile, or from the process environment.
+func (t *Template) Execute(env parse.Lookuper) (string, error) {
+	if env == nil {
+		env = t.src
+	}
+	if env == nil {
+		env = parse.Env(os.Environ()).Map()
+	}
+	p := t.parser
+	p.Source = env
+	if t.secrets {
+		p.Source = parse.NewFileSecrets(env)
+	}
+	return p.Execute(t.tree)
+}
@@ -0,0 +1,55 @@
+package envsubst
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/a8m/envsubst/parse"
+)
+
+func TestTemplate(t *testing.T) {
+	tmpl, err := Compile("host: ${TENANT}.${DOMAIN:=example.com} ${DOMAIN}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tenant := fmt.Sprintf("tenant%d", i)
+			out, err := tmpl.Execute(parse.Map{"TENANT": tenant})
+			expected := fmt.Sprintf("host: %s.example.com example.com", tenant)
+			if out != expected || err != nil {
+				t.Errorf("got %q (error: %v), expected %q", out, err, expected)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if _, err := Compile("${"); err == nil {
+		t.Error("expected compile error")
+	}
+}
+
+func TestTemplateNilSource(t *testing.T) {
+	t.Setenv("TENANT", "acme")
+	tests := []struct {
+		opts     []Option
+		expected string
+	}{
+		{nil, "acme"},
+		{[]Option{WithFileSecrets()}, "acme"},
+		{[]Option{WithSource(parse.Map{"TENANT": "other"})}, "other"},
+		{[]Option{WithEnv([]string{"TENANT=compiled"}), WithFileSecrets()}, "compiled"},
+	}
+	for _, test := range tests {
+		tmpl, err := Compile("${TENANT}", test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := tmpl.Execute(nil); out != test.expected || err != nil {
+			t.Errorf("got %q (error: %v), expected %q", out, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package vars
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/a8m/envsubst/parse"
+)
+
+// ReadDir reads the variables of a directory holding one file per variable,
+// such as a Kubernetes ConfigMap or Secret volume: the file dir/DB_HOST holds
+// the value of the variable DB_HOST, without its trailing newline. The files
+// of the subdirectories are flattened as the nested keys of ParseVars: the
+// file dir/db/port is both the variable DB_PORT, named by the upper-cased path
+// joined by sep, and the variable db.port.
+//
+// Symbolic links are followed, and entries starting with '.' are skipped, so
+// that the ..data indirection of Kubernetes volumes is read only once. Files
+// larger than parse.DefaultMaxSecretSize are rejected.
+func ReadDir(dir, sep string) (parse.Map, error) {
+	m := parse.Map{}
+	if err := readDir(m, map[string]string{}, dir, nil, sep, nil); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readDir reads the files of dir at path into m, as set does. parents holds
+// the directories being read, to detect symbolic link loops.
+func readDir(m parse.Map, paths map[string]string, dir string, path []string, sep string, parents []os.FileInfo) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	for _, p := range parents {
+		if os.SameFile(p, info) {
+			return nil
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	parents = append(parents, info)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		name := filepath.Join(dir, e.Name())
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		p := append(path[:len(path):len(path)], e.Name())
+		if fi.IsDir() {
+			if err := readDir(m, paths, name, p, sep, parents); err != nil {
+				return err
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		v, err := parse.ReadValue(name, 0)
+		if err != nil {
+			return err
+		}
+		if err := set(m, paths, p, sep, v); err != nil {
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+	}
+	return nil
+}
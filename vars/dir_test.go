@@ -0,0 +1,56 @@
+package vars
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/a8m/envsubst/parse"
+)
+
+// TestReadDir reads a directory laid out as a Kubernetes volume:
+//
+//	DB_HOST -> ..data/DB_HOST
+//	db -> ..data/db
+//	..data -> ..2024_01_01
+//	..2024_01_01/DB_HOST
+//	..2024_01_01/db/port
+func TestReadDir(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "..2024_01_01")
+	for _, d := range []string{data, filepath.Join(data, "db")} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{"DB_HOST": "localhost\n", "db/port": "5432"}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(data, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{"..data": "..2024_01_01", "DB_HOST": "..data/DB_HOST", "db": "..data/db", "loop": "."}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := ReadDir(dir, "_")
+	expected := parse.Map{"DB_HOST": "localhost", "DB_PORT": "5432", "db.port": "5432"}
+	if err != nil || !reflect.DeepEqual(m, expected) {
+		t.Errorf("got %q (error: %v), expected %q", m, err, expected)
+	}
+	if _, err := ReadDir(filepath.Join(dir, "missing"), "_"); err == nil {
+		t.Error("expected error reading a missing directory")
+	}
+	if err := os.WriteFile(filepath.Join(data, "db_port"), []byte("5433"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..data/db_port", filepath.Join(dir, "db_port")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadDir(dir, "_"); err == nil {
+		t.Error("expected error reading db_port and db/port")
+	}
+}
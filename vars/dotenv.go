@@ -0,0 +1,215 @@
+package vars
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/a8m/envsubst"
+	"github.com/a8m/envsubst/parse"
+)
+
+// ReadDotenv reads the variables of the named file in the dotenv format, as
+// ParseDotenv does.
+func ReadDotenv(filename string, opts ...envsubst.Option) (parse.Map, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseDotenv(f, append([]envsubst.Option{envsubst.WithName(filename)}, opts...)...)
+}
+
+// ParseDotenv reads variables in the dotenv format from r, and returns them
+// as a source that can be given to envsubst.WithSource. The format is:
+//
+//	# comments and blank lines are ignored
+//	KEY=value                  # unquoted, trimmed, up to an inline comment
+//	export KEY=value           # the export prefix is ignored
+//	KEY='literal $value'       # single quotes keep the value as is
+//	KEY="line\nwith ${OTHER}"  # double quotes allow escapes and newlines
+//
+// Unquoted and double-quoted values are substituted as templates, with the
+// variables defined earlier in the input, then with the variables configured
+// by opts, which default to the process environment. \$ escapes a dollar sign
+// in double-quoted values.
+func ParseDotenv(r io.Reader, opts ...envsubst.Option) (parse.Map, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := envsubst.NewParser("dotenv", opts...)
+	src := p.Source
+	if src == nil {
+		src = p.Env.Map()
+	}
+	vars := parse.NewOverlay(src)
+	p.Source = vars
+	d := &dotenv{input: string(b), line: 1}
+	m := parse.Map{}
+	for {
+		key, value, expand, err := d.next()
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", p.Name, d.line, err)
+		}
+		if key == "" {
+			return m, nil
+		}
+		if expand {
+			line := d.line
+			if value, err = p.Parse(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", p.Name, line, err)
+			}
+		}
+		vars.Set(key, value)
+		m[key] = value
+	}
+}
+
+// dotenv scans the entries of a dotenv input.
+type dotenv struct {
+	input string
+	pos   int
+	line  int // line of the entry being scanned
+}
+
+// next returns the next entry of the input, and whether its value is to be
+// substituted. It returns an empty key at the end of the input.
+func (d *dotenv) next() (key, value string, expand bool, err error) {
+	for {
+		d.skip(" \t\r\n")
+		if d.pos == len(d.input) {
+			return "", "", false, nil
+		}
+		if d.input[d.pos] != '#' {
+			break
+		}
+		d.skipLine()
+	}
+	if rest := d.input[d.pos:]; strings.HasPrefix(rest, "export ") || strings.HasPrefix(rest, "export\t") {
+		d.pos += len("export")
+		d.skip(" \t")
+	}
+	start := d.pos
+	for d.pos < len(d.input) && isKeyChar(d.input[d.pos], d.pos == start) {
+		d.pos++
+	}
+	if key = d.input[start:d.pos]; key == "" {
+		return "", "", false, fmt.Errorf("invalid key")
+	}
+	d.skip(" \t")
+	if d.pos == len(d.input) || d.input[d.pos] != '=' {
+		return "", "", false, fmt.Errorf("expected '=' after %s", key)
+	}
+	d.pos++
+	d.skip(" \t")
+	if d.pos == len(d.input) {
+		return key, "", false, nil
+	}
+	switch d.input[d.pos] {
+	case '\'':
+		value, err = d.quoted()
+	case '"':
+		value, err = d.doubleQuoted()
+		expand = true
+	default:
+		value, expand = d.unquoted(), true
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+	d.skip(" \t\r")
+	switch {
+	case d.pos == len(d.input):
+	case d.input[d.pos] == '#':
+		d.skipLine()
+	case d.input[d.pos] != '\n':
+		return "", "", false, fmt.Errorf("unexpected character %q after the value of %s", d.input[d.pos], key)
+	}
+	return key, value, expand, nil
+}
+
+// quoted scans a single-quoted value.
+func (d *dotenv) quoted() (string, error) {
+	end := strings.IndexByte(d.input[d.pos+1:], '\'')
+	if end < 0 {
+		return "", fmt.Errorf("unterminated quoted value")
+	}
+	value := d.input[d.pos+1 : d.pos+1+end]
+	d.pos += end + 2
+	d.line += strings.Count(value, "\n")
+	return value, nil
+}
+
+// doubleQuoted scans a double-quoted value, and returns it unescaped.
+func (d *dotenv) doubleQuoted() (string, error) {
+	var b strings.Builder
+	for i := d.pos + 1; i < len(d.input); i++ {
+		c := d.input[i]
+		switch {
+		case c == '"':
+			d.line += strings.Count(d.input[d.pos:i], "\n")
+			d.pos = i + 1
+			return b.String(), nil
+		case c == '\\' && i+1 < len(d.input):
+			i++
+			switch c = d.input[i]; c {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '$':
+				b.WriteString("$$")
+			case '"', '\\':
+				b.WriteByte(c)
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted value")
+}
+
+// unquoted scans an unquoted value up to the end of the line or an inline
+// comment, and returns it trimmed.
+func (d *dotenv) unquoted() string {
+	start := d.pos
+	for d.pos < len(d.input) && d.input[d.pos] != '\n' {
+		if d.input[d.pos] == '#' && (d.input[d.pos-1] == ' ' || d.input[d.pos-1] == '\t') {
+			break
+		}
+		d.pos++
+	}
+	return strings.TrimSpace(d.input[start:d.pos])
+}
+
+// skip skips the characters of the input that are in chars.
+func (d *dotenv) skip(chars string) {
+	for d.pos < len(d.input) && strings.IndexByte(chars, d.input[d.pos]) >= 0 {
+		if d.input[d.pos] == '\n' {
+			d.line++
+		}
+		d.pos++
+	}
+}
+
+// skipLine skips the rest of the line, up to the newline.
+func (d *dotenv) skipLine() {
+	if i := strings.IndexByte(d.input[d.pos:], '\n'); i >= 0 {
+		d.pos += i
+		return
+	}
+	d.pos = len(d.input)
+}
+
+// isKeyChar reports whether c may appear in a key, at its start if first.
+func isKeyChar(c byte, first bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
+}
@@ -0,0 +1,62 @@
+package vars
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/a8m/envsubst"
+	"github.com/a8m/envsubst/parse"
+)
+
+var dotenvTests = []struct {
+	name     string
+	input    string
+	expected parse.Map
+	err      string
+}{
+	{"empty", "", parse.Map{}, ""},
+	{"comments", "# comment\n\n  # indented\nA=a", parse.Map{"A": "a"}, ""},
+	{"unquoted", "A = a b  \nB=\nC=c#d\nD=d #comment", parse.Map{"A": "a b", "B": "", "C": "c#d", "D": "d"}, ""},
+	{"export", "export A=a\nexport\tB=b", parse.Map{"A": "a", "B": "b"}, ""},
+	{"crlf", "A=a\r\nB='b'\r\n", parse.Map{"A": "a", "B": "b"}, ""},
+	{"single quotes", "A='$BAR \\n # x'", parse.Map{"A": "$BAR \\n # x"}, ""},
+	{"double quotes", `A="a\tb\n\"c\" \\ \x # $BAR"`, parse.Map{"A": "a\tb\n\"c\" \\ \\x # bar"}, ""},
+	{"multi line", "A=\"a\nb\"\nB='c\nd' # comment\nC=c", parse.Map{"A": "a\nb", "B": "c\nd", "C": "c"}, ""},
+	{"escaped dollar", `A="\$BAR $$BAR"`, parse.Map{"A": "$BAR $BAR"}, ""},
+	{"interpolation", "A=a\nB=${A}b\nC=\"${B:-x}c$BAR\"\nA=${A}a", parse.Map{"A": "aa", "B": "ab", "C": "abcbar"}, ""},
+	{"invalid key", "A=a\n1A=b", nil, "dotenv:2: invalid key"},
+	{"missing equals", "A=a\n\nB b", nil, "dotenv:3: expected '=' after B"},
+	{"unterminated", "A=a\nB=\"b\n", nil, "dotenv:2: unterminated quoted value"},
+	{"trailing", "A='a' b", nil, "dotenv:1: unexpected character 'b' after the value of A"},
+	{"syntax", "A=a\nB=${A", nil, "dotenv:2: closing brace expected"},
+}
+
+func TestParseDotenv(t *testing.T) {
+	for _, test := range dotenvTests {
+		m, err := ParseDotenv(strings.NewReader(test.input), envsubst.WithEnv([]string{"BAR=bar"}))
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(m, test.expected) {
+			t.Errorf("%s: got %q (error: %v), expected %q", test.name, m, err, test.expected)
+		}
+	}
+}
+
+func TestReadDotenv(t *testing.T) {
+	m, err := ReadDotenv("testdata/app.env", envsubst.WithEnv(nil))
+	expected := parse.Map{"HOST": "localhost", "PORT": "8080", "URL": "http://localhost:8080/"}
+	if err != nil || !reflect.DeepEqual(m, expected) {
+		t.Errorf("got %q (error: %v), expected %q", m, err, expected)
+	}
+	_, err = ParseDotenv(strings.NewReader("A=$NOTSET"), envsubst.WithEnv(nil), envsubst.NoUnset())
+	var unset *parse.UnsetError
+	if !errors.As(err, &unset) || unset.Variable != "NOTSET" {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
@@ -0,0 +1,121 @@
+// Package vars reads variables from files, to be used as a source of
+// variables by the envsubst package.
+package vars
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/a8m/envsubst/parse"
+	"gopkg.in/yaml.v3"
+)
+
+// ReadVars reads the variables of the named JSON or YAML file, as ParseVars does.
+func ReadVars(filename, sep string) (parse.Map, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := ParseVars(f, sep)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return m, nil
+}
+
+// ParseVars reads a JSON or YAML document from r, and returns its values as
+// variables. Nested keys are flattened: the value at the path db.host is
+// both the variable DB_HOST, named by the upper-cased keys joined by sep, and
+// the variable db.host, named by the keys joined by dots, which is referenced
+// as ${db.host} with the envsubst.Dotted option. Sequence elements are keyed by their
+// index, scalars are kept as written, and null values are empty. It fails if
+// two paths are flattened to the same variable, such as db_host and db.host.
+func ParseVars(r io.Reader, sep string) (parse.Map, error) {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil && err != io.EOF {
+		return nil, err
+	}
+	m := parse.Map{}
+	if len(doc.Content) == 0 {
+		return m, nil
+	}
+	if root := doc.Content[0]; root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping of variables", root.Line)
+	}
+	if err := flatten(m, map[string]string{}, &doc, nil, sep); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// flatten adds the scalars of the node n at path to m, as set does.
+func flatten(m parse.Map, paths map[string]string, n *yaml.Node, path []string, sep string) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			if err := flatten(m, paths, c, path, sep); err != nil {
+				return err
+			}
+		}
+	case yaml.AliasNode:
+		return flatten(m, paths, n.Alias, path, sep)
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: unsupported non-scalar key", k.Line)
+			}
+			if err := flatten(m, paths, v, append(path[:len(path):len(path)], k.Value), sep); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			if err := flatten(m, paths, c, append(path[:len(path):len(path)], strconv.Itoa(i)), sep); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		value := n.Value
+		if n.ShortTag() == "!!null" {
+			value = ""
+		}
+		if err := set(m, paths, path, sep, value); err != nil {
+			return fmt.Errorf("line %d: %v", n.Line, err)
+		}
+	}
+	return nil
+}
+
+// set adds the value at path to m, as both the variable named by the
+// upper-cased keys of path joined by sep, and the variable named by the keys
+// joined by dots. paths holds the path of each variable added to m, to
+// detect collisions.
+func set(m parse.Map, paths map[string]string, path []string, sep, value string) error {
+	p := pathString(path)
+	for _, name := range []string{strings.ToUpper(strings.Join(path, sep)), strings.Join(path, ".")} {
+		if other, ok := paths[name]; ok && other != p {
+			return fmt.Errorf("%s and %s both set the variable %s", other, p, name)
+		}
+		paths[name] = p
+		m[name] = value
+	}
+	return nil
+}
+
+// pathString returns the keys of path joined by dots, quoting the keys
+// holding dots, such as "db.host" and db.host.
+func pathString(path []string) string {
+	keys := make([]string, len(path))
+	for i, k := range path {
+		if strings.Contains(k, ".") {
+			k = strconv.Quote(k)
+		}
+		keys[i] = k
+	}
+	return strings.Join(keys, ".")
+}
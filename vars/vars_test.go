@@ -0,0 +1,44 @@
+package vars
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/a8m/envsubst"
+	"github.com/a8m/envsubst/parse"
+)
+
+func TestReadVars(t *testing.T) {
+	expected := parse.Map{
+		"DB_HOST": "localhost", "db.host": "localhost",
+		"DB_PORT": "5432", "db.port": "5432",
+		"DB_REPLICAS_0": "db1", "db.replicas.0": "db1",
+		"DB_REPLICAS_1": "db2", "db.replicas.1": "db2",
+		"DEBUG": "true", "debug": "true",
+		"EMPTY": "", "empty": "",
+		"VERSION": "08", "version": "08",
+	}
+	for _, name := range []string{"testdata/vars.yaml", "testdata/vars.json"} {
+		m, err := ReadVars(name, "_")
+		if err != nil || !reflect.DeepEqual(m, expected) {
+			t.Errorf("%s: got %q (error: %v), expected %q", name, m, err, expected)
+		}
+	}
+	m, err := ParseVars(strings.NewReader("a: {b: {c: x}}"), "__")
+	if err != nil || m["A__B__C"] != "x" || m["a.b.c"] != "x" {
+		t.Errorf("separator: got %q (error: %v)", m, err)
+	}
+	m, _ = ReadVars("testdata/vars.yaml", "_")
+	if out, err := envsubst.Eval("${db.host}:$DB_PORT ${db.replicas.1}", envsubst.WithSource(m), envsubst.Dotted()); out != "localhost:5432 db2" || err != nil {
+		t.Errorf("dotted: got %q (error: %v)", out, err)
+	}
+	if m, err := ParseVars(strings.NewReader(""), "_"); err != nil || len(m) != 0 {
+		t.Errorf("empty: got %q (error: %v)", m, err)
+	}
+	for _, input := range []string{"- a\n- b", "just a string", "a: [b", "? [a]\n: b", "db_host: a\ndb: {host: b}", "db.host: a\ndb: {host: b}"} {
+		if _, err := ParseVars(strings.NewReader(input), "_"); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}